@@ -0,0 +1,183 @@
+package surfstore
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Run an anti-entropy round every interval in the background (see RepairBlocks)
+func (m *MetaStore) StartAntiEntropy(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid anti-entropy interval %v", interval)
+	}
+	stop := make(chan struct{})
+	m.mtx.Lock()
+	m.antiEntropyStop = stop
+	m.mtx.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if m.Raft != nil {
+				if isLeader, _ := m.Raft.Leader(); !isLeader {
+					continue
+				}
+			}
+			if repaired, e := m.RepairBlocks(); e != nil {
+				log.Printf("Anti-entropy failed: %v\n", e)
+			} else if repaired > 0 {
+				log.Printf("Anti-entropy repaired %d block copies\n", repaired)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop the anti-entropy rounds
+func (m *MetaStore) StopAntiEntropy() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.antiEntropyStop != nil {
+		close(m.antiEntropyStop)
+		m.antiEntropyStop = nil
+	}
+}
+
+// Run one anti-entropy round: fetch the Merkle tree of every ring range from
+// every BlockStore that is not dead and compare them. In differing leaves,
+// blocks missing from a host of the range are copied from another BlockStore
+// holding them, and blocks held by a BlockStore that does not host the range are
+// dropped from it once every live host has a copy. Returns the number of block
+// copies and drops. Runs under membershipMtx, so it never races a migration.
+func (m *MetaStore) RepairBlocks() (int, error) {
+	m.membershipMtx.Lock()
+	defer m.membershipMtx.Unlock()
+	m.mtx.RLock()
+	ring := m.BlockStoreRing.Copy()
+	m.mtx.RUnlock()
+	if ring.LoadFactor > 0 {
+		// spilled blocks live outside the ranges that host them
+		return 0, fmt.Errorf("anti-entropy does not support bounded-load placement")
+	}
+
+	ranges := ring.Ranges()
+	merkleRanges := make([]MerkleRange, len(ranges))
+	for i, r := range ranges {
+		merkleRanges[i] = MerkleRange{LowerIndex: r.LowerIndex, UpperIndex: r.UpperIndex, RingSize: ring.RingSize}
+	}
+	dead := m.deadNodes()
+	addrs := make([]string, 0)
+	trees := make(map[string][]MerkleTree)
+	for _, addr := range ring.Addrs() {
+		if dead[addr] {
+			continue
+		}
+		nodeTrees := make([]MerkleTree, 0)
+		if e := rpcCall(addr, "BlockStore.GetMerkleTrees", merkleRanges, &nodeTrees); e != nil {
+			log.Printf("Anti-entropy skips BlockStore %s: %v\n", addr, e)
+			continue
+		}
+		addrs = append(addrs, addr)
+		trees[addr] = nodeTrees
+	}
+
+	copies := newTransferBuilder()
+	deletes := newTransferBuilder()
+	for i, r := range ranges {
+		if e := planRangeRepair(r, merkleRanges[i], i, addrs, trees, copies, deletes); e != nil {
+			return 0, e
+		}
+	}
+	plan := MigrationPlan{BlockCopies: copies.steps, BlockDeletes: deletes.steps}
+	repaired := 0
+	for _, step := range plan.BlockCopies {
+		repaired += len(step.Transfer.BlockHashes)
+	}
+	for _, step := range plan.BlockDeletes {
+		repaired += len(step.Transfer.BlockHashes)
+	}
+	return repaired, m.executeMigration(plan)
+}
+
+// Add the copies and drops that bring range i back in sync to copies and deletes.
+// addrs are the BlockStores whose trees were fetched.
+func planRangeRepair(r RingRange, merkleRange MerkleRange, i int, addrs []string, trees map[string][]MerkleTree,
+	copies *transferBuilder, deletes *transferBuilder) error {
+	hostSet := addrSet(r.Hosts)
+	hosts := make([]string, 0)
+	for _, addr := range r.Hosts {
+		if _, ok := trees[addr]; ok {
+			hosts = append(hosts, addr)
+		}
+	}
+
+	// hosts are compared with the first live host, other BlockStores with an empty tree
+	empty := buildMerkleTree(merkleRange, nil)
+	diff := make(map[int]bool)
+	involved := make([]string, 0)
+	for _, addr := range addrs {
+		tree := trees[addr][i]
+		reference := empty
+		if hostSet[addr] {
+			reference = trees[hosts[0]][i]
+		} else if tree.Blocks == 0 {
+			continue
+		}
+		for _, leaf := range diffMerkleLeaves(reference, tree) {
+			diff[leaf] = true
+		}
+		involved = append(involved, addr)
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	leaves := make([]int, 0, len(diff))
+	for leaf := range diff {
+		leaves = append(leaves, leaf)
+	}
+	sort.Ints(leaves)
+
+	holders := make(map[string][]string)
+	for _, addr := range involved {
+		blockHashes := make([]string, 0)
+		request := MerkleLeafRequest{Range: merkleRange, Leaves: leaves}
+		if e := rpcCall(addr, "BlockStore.GetMerkleLeafHashes", request, &blockHashes); e != nil {
+			return fmt.Errorf("BlockStore %s: %v", addr, e)
+		}
+		for _, blockHash := range blockHashes {
+			holders[blockHash] = append(holders[blockHash], addr)
+		}
+	}
+	blockHashes := make([]string, 0, len(holders))
+	for blockHash := range holders {
+		blockHashes = append(blockHashes, blockHash)
+	}
+	sort.Strings(blockHashes)
+
+	for _, blockHash := range blockHashes {
+		holderSet := addrSet(holders[blockHash])
+		srcAddr := chooseSource(holders[blockHash], hostSet, nil)
+		for _, addr := range hosts {
+			if !holderSet[addr] {
+				copies.add(srcAddr, addr, blockHash)
+			}
+		}
+		if len(hosts) == 0 {
+			// keep misplaced blocks while no host of the range is reachable
+			continue
+		}
+		for _, addr := range holders[blockHash] {
+			if !hostSet[addr] {
+				deletes.add(addr, "", blockHash)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package surfstore
+
+import (
+	"testing"
+)
+
+func TestRepairBlocksRestoresReplicasAndDropsMisplacedBlocks(t *testing.T) {
+	addrs, stores := startBlockStores(t, 3, 128)
+	ring := NewConsistentHashRing(128, addrs)
+	ring.Replicas = 2
+	for i, store := range stores {
+		succ := false
+		if e := store.SetRing(RingUpdate{Ring: ring, SelfAddr: addrs[i]}, &succ); e != nil {
+			t.Fatal(e)
+		}
+	}
+	meta := NewMetaStore(ring)
+
+	// every fourth block misses its second replica, and every fifth also sits on the BlockStore not hosting it
+	hashes := make([]string, 0)
+	misplaced := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		block := testBlock(i)
+		hash := GetBlockHashString(block.BlockData)
+		hashes = append(hashes, hash)
+		hosts := nodeAddrs(ring.FindBlockHosts(hash))
+		if i%4 == 0 {
+			hosts = hosts[:1]
+		}
+		if i%5 == 0 {
+			for _, addr := range addrs {
+				if !addrSet(nodeAddrs(ring.FindBlockHosts(hash)))[addr] {
+					misplaced[hash] = addr
+					hosts = append(hosts, addr)
+				}
+			}
+		}
+		for _, addr := range hosts {
+			succ := false
+			if e := rpcCall(addr, "BlockStore.ReplicateBlock", block, &succ); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+
+	repaired, e := meta.RepairBlocks()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if want := 15 + len(misplaced); repaired != want {
+		t.Errorf("repaired %d block copies, want %d", repaired, want)
+	}
+	for _, hash := range hashes {
+		for _, host := range ring.FindBlockHosts(hash) {
+			if missing, e := missingBlocks(host.Addr, []string{hash}); e != nil || len(missing) > 0 {
+				t.Errorf("host %s misses block %s after the repair (%v)", host.Addr, hash, e)
+			}
+		}
+	}
+	for hash, addr := range misplaced {
+		if missing, e := missingBlocks(addr, []string{hash}); e != nil || len(missing) == 0 {
+			t.Errorf("%s still holds block %s it does not host (%v)", addr, hash, e)
+		}
+	}
+
+	if repaired, e := meta.RepairBlocks(); e != nil || repaired != 0 {
+		t.Errorf("second repair made %d block copies (%v), want none", repaired, e)
+	}
+}
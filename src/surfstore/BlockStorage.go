@@ -0,0 +1,97 @@
+package surfstore
+
+import (
+	"sync"
+)
+
+// BlockStorage is the storage engine behind a BlockStore. The BlockStore RPC
+// methods only talk to this interface, so a new engine can be plugged in by
+// passing it to NewBlockStoreWithStorage. net/rpc serves calls concurrently,
+// so every engine must be safe for concurrent use.
+type BlockStorage interface {
+	// Read the block with the given hash. The bool result reports whether it exists.
+	Get(blockHash string) (Block, bool, error)
+
+	// Store a block under the given hash
+	Put(blockHash string, block Block) error
+
+	// Report whether a block with the given hash is stored
+	Has(blockHash string) (bool, error)
+
+	// Get the size in bytes of the block with the given hash without reading it.
+	// The bool result reports whether it exists.
+	Size(blockHash string) (int, bool, error)
+
+	// Remove the block with the given hash, if present
+	Delete(blockHash string) error
+
+	// Call fn with the hash of every stored block whose ring index lies in
+	// [lowerIndex, upperIndex] (in modulo sense). Iteration stops at the first
+	// error returned by fn. fn may run while the engine holds a lock, so it must
+	// not call back into the storage.
+	ForEachInRange(lowerIndex int, upperIndex int, ringSize int, fn func(blockHash string) error) error
+}
+
+// MemoryBlockStorage keeps blocks in a map and loses them when the process exits
+type MemoryBlockStorage struct {
+	mtx      sync.RWMutex
+	blockMap map[string]Block
+}
+
+func NewMemoryBlockStorage() *MemoryBlockStorage {
+	return &MemoryBlockStorage{
+		blockMap: map[string]Block{},
+	}
+}
+
+func (ms *MemoryBlockStorage) Get(blockHash string) (Block, bool, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	block, exist := ms.blockMap[blockHash]
+	return block, exist, nil
+}
+
+func (ms *MemoryBlockStorage) Put(blockHash string, block Block) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.blockMap[blockHash] = block
+	return nil
+}
+
+func (ms *MemoryBlockStorage) Has(blockHash string) (bool, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	_, exist := ms.blockMap[blockHash]
+	return exist, nil
+}
+
+func (ms *MemoryBlockStorage) Size(blockHash string) (int, bool, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	block, exist := ms.blockMap[blockHash]
+	return len(block.BlockData), exist, nil
+}
+
+func (ms *MemoryBlockStorage) Delete(blockHash string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	delete(ms.blockMap, blockHash)
+	return nil
+}
+
+func (ms *MemoryBlockStorage) ForEachInRange(lowerIndex int, upperIndex int, ringSize int, fn func(blockHash string) error) error {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	for blockHash := range ms.blockMap {
+		if !InRingRange(HashMod(blockHash, ringSize), lowerIndex, upperIndex, ringSize) {
+			continue
+		}
+		if e := fn(blockHash); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+var _ BlockStorage = new(MemoryBlockStorage)
+var _ BlockStorage = new(DiskBlockStorage)
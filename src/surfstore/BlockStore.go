@@ -1,25 +1,65 @@
 package surfstore
 
 import (
-	"net/rpc"
+	"fmt"
+	"sync"
 )
 
+// RingSize, SelfAddr, ring and readOnly can be changed while RPCs are served, mtx guards them
 type BlockStore struct {
-	BlockMap map[string]Block
+	Storage  BlockStorage
 	RingSize int
+	// Address of this BlockStore in the ring, learned from the MetaStore
+	SelfAddr string
+
+	mtx sync.RWMutex
+	// Latest ring known to this BlockStore, nil until the MetaStore or a peer sends one
+	ring *ConsistentHashRing
+	// Target ring of a migration in progress, nil if there is none
+	pendingRing *ConsistentHashRing
+	// Set while this BlockStore is drained, PutBlock then rejects every block
+	readOnly bool
+	// Gossip state, nil unless started (see StartGossip)
+	gossip *gossiper
 }
 
 // Get the BlockMap of the BlockStore for debugging with run-debug.sh
 func (bs *BlockStore) GetBlockMap(succ *bool, serverBlockInfoMap *map[string]Block) error {
-	for k, v := range bs.BlockMap {
-		(*serverBlockInfoMap)[k] = v
+	hashes, e := bs.allHashes()
+	if e != nil {
+		return e
+	}
+	for _, k := range hashes {
+		v, exist, e := bs.Storage.Get(k)
+		if e != nil {
+			return e
+		}
+		if exist {
+			(*serverBlockInfoMap)[k] = v
+		}
 	}
 
 	return nil
 }
 
+// Get a block. While a migration is in progress, or when asked for a block it
+// does not host, a BlockStore that misses the block reads it from its other
+// hosts, as a client may be reading from a new host before its copy arrived or
+// from an old host after it dropped the block. If none of them has it either,
+// a block this BlockStore does not host fails with a WrongOwnerError.
 func (bs *BlockStore) GetBlock(blockHash string, blockData *Block) error {
-	block, exist := bs.BlockMap[blockHash]
+	block, exist, e := bs.Storage.Get(blockHash)
+	if e != nil {
+		return e
+	}
+	if !exist {
+		block, exist = bs.readFromOwners(blockHash)
+	}
+	if !exist {
+		if e := bs.checkOwner(blockHash); e != nil {
+			return e
+		}
+	}
 
 	if exist {
 		blockData.BlockData = block.BlockData
@@ -31,18 +71,95 @@ func (bs *BlockStore) GetBlock(blockHash string, blockData *Block) error {
 	return nil
 }
 
+// Get a block from this BlockStore only, failing if it does not hold it
+func (bs *BlockStore) GetLocalBlock(blockHash string, blockData *Block) error {
+	block, exist, e := bs.Storage.Get(blockHash)
+	if e != nil {
+		return e
+	}
+	if !exist {
+		return fmt.Errorf("BlockStore %s does not hold block %s", bs.selfAddr(), blockHash)
+	}
+	*blockData = block
+	return nil
+}
+
+// Read a block missing here from its other hosts in the current and the pending
+// ring. Only done while a migration is in progress or if this BlockStore does not host the block.
+func (bs *BlockStore) readFromOwners(blockHash string) (Block, bool) {
+	bs.mtx.RLock()
+	owners := make([]string, 0)
+	if bs.ring != nil && bs.SelfAddr != "" && bs.ring.LoadFactor == 0 {
+		hosts := nodeAddrs(bs.ring.FindBlockHosts(blockHash))
+		if bs.pendingRing != nil {
+			hosts = append(hosts, nodeAddrs(bs.pendingRing.FindBlockHosts(blockHash))...)
+		}
+		if bs.pendingRing != nil || !addrSet(hosts)[bs.SelfAddr] {
+			seen := map[string]bool{bs.SelfAddr: true}
+			for _, addr := range hosts {
+				if !seen[addr] {
+					seen[addr] = true
+					owners = append(owners, addr)
+				}
+			}
+		}
+	}
+	bs.mtx.RUnlock()
+
+	for _, addr := range owners {
+		var block Block
+		if e := rpcCall(addr, "BlockStore.GetLocalBlock", blockHash, &block); e == nil {
+			return block, true
+		}
+	}
+	return Block{}, false
+}
+
+// Store a block uploaded by a client. Blocks this BlockStore does not host in
+// the latest ring it knows are rejected with a WrongOwnerError, as the client used
+// an outdated BlockStore map. A read-only BlockStore rejects every block.
 func (bs *BlockStore) PutBlock(block Block, succ *bool) error {
+	bs.mtx.RLock()
+	readOnly := bs.readOnly
+	bs.mtx.RUnlock()
+	if readOnly {
+		return fmt.Errorf("BlockStore %s is being drained and is read-only", bs.selfAddr())
+	}
 	blockHash := GetBlockHashString(block.BlockData)
-	bs.BlockMap[blockHash] = block
+	if e := bs.checkOwner(blockHash); e != nil {
+		return e
+	}
+	return bs.ReplicateBlock(block, succ)
+}
+
+// Store a block sent by another BlockStore during a migration, without checking ownership:
+// the destination may not have learned the ring that makes it the owner yet.
+func (bs *BlockStore) ReplicateBlock(block Block, succ *bool) error {
+	blockHash := GetBlockHashString(block.BlockData)
+	if e := bs.Storage.Put(blockHash, block); e != nil {
+		return e
+	}
 	*succ = true
 
 	return nil
 }
 
+// Store a batch of blocks sent by another BlockStore, see ReplicateBlock
+func (bs *BlockStore) ReplicateBlocks(blocks []Block, succ *bool) error {
+	for _, block := range blocks {
+		if e := bs.Storage.Put(GetBlockHashString(block.BlockData), block); e != nil {
+			return e
+		}
+	}
+	*succ = true
+	return nil
+}
+
 func (bs *BlockStore) hasBlock(blockHash string, hasBlock *bool) error {
-	_, *hasBlock = bs.BlockMap[blockHash]
+	exist, e := bs.Storage.Has(blockHash)
+	*hasBlock = exist
 
-	return nil
+	return e
 }
 
 //Given a list of hashes “in”, returns a list containing the
@@ -52,14 +169,16 @@ func (bs *BlockStore) HasBlocks(blockHashesIn []string, blockHashesOut *[]string
 
 	for _, blockHash := range blockHashesIn {
 		hasBlock := false
-		_ = bs.hasBlock(blockHash, &hasBlock)
+		if e := bs.hasBlock(blockHash, &hasBlock); e != nil {
+			return e
+		}
 
 		if hasBlock {
 			hasBlocksSlice = append(hasBlocksSlice, blockHash)
 		}
 	}
 
-	blockHashesOut = &hasBlocksSlice
+	*blockHashesOut = hasBlocksSlice
 
 	return nil
 }
@@ -76,62 +195,310 @@ func mod(a int, b int) int {
 	return m
 }
 
-// Migrate specified blocks from this node to another node.
-func (bs *BlockStore) MigrateBlocks(inst MigrationInstruction, succ *bool) error {
-	// connect to the server
-	conn, e := rpc.DialHTTP("tcp", inst.DestAddr)
+// Collect the hashes of the stored blocks with ring index in [lowerIndex, upperIndex]
+func (bs *BlockStore) hashesInRange(lowerIndex int, upperIndex int) ([]string, error) {
+	ringSize := bs.ringSize()
+	hashes := make([]string, 0)
+	e := bs.Storage.ForEachInRange(lowerIndex, upperIndex, ringSize, func(blockHash string) error {
+		hashes = append(hashes, blockHash)
+		return nil
+	})
+	return hashes, e
+}
+
+// Collect the hashes of all stored blocks
+func (bs *BlockStore) allHashes() ([]string, error) {
+	return bs.hashesInRange(0, bs.ringSize()-1)
+}
+
+func (bs *BlockStore) selfAddr() string {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	return bs.SelfAddr
+}
+
+func (bs *BlockStore) ringSize() int {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	return bs.RingSize
+}
+
+// Get the ring size this BlockStore computes block indices with
+func (bs *BlockStore) GetRingSize(succ bool, ringSize *int) error {
+	*ringSize = bs.ringSize()
+	return nil
+}
+
+// Set the ring size this BlockStore computes block indices with, e.g. when it joins a resized ring
+func (bs *BlockStore) SetRingSize(ringSize int, succ *bool) error {
+	bs.mtx.Lock()
+	bs.RingSize = ringSize
+	bs.mtx.Unlock()
+	*succ = true
+	return nil
+}
+
+// Drop the blocks this node does not host in inst.Ring and adopt its ring size.
+// Run on every BlockStore once a ring resize is committed, or with the old ring
+// once one is aborted.
+func (bs *BlockStore) CommitRehash(inst RehashInstruction, succ *bool) error {
+	if e := inst.Ring.Validate(); e != nil {
+		return e
+	}
+	hashes, e := bs.allHashes()
 	if e != nil {
 		return e
 	}
+	keep := make(map[string]bool, len(inst.Keep))
+	for _, k := range inst.Keep {
+		keep[k] = true
+	}
+	for _, k := range hashes {
+		hosted := keep[k]
+		for _, host := range inst.Ring.FindBlockHosts(k) {
+			if host.Addr == inst.SelfAddr {
+				hosted = true
+				break
+			}
+		}
+		if hosted {
+			continue
+		}
+		if e = bs.Storage.Delete(k); e != nil {
+			return e
+		}
+	}
+	return bs.SetRingSize(inst.Ring.RingSize, succ)
+}
+
+// Migrate specified blocks from this node to another node.
+func (bs *BlockStore) MigrateBlocks(inst MigrationInstruction, succ *bool) error {
 	// migrate the blocks with ring index between inst.LowerIndex and inst.UpperIndex (in modulo sense)
 	// in this BlockStore server to another BlockStore server with address inst.DestAddr
-	// For each block to migrate, you could do:
-	// e = conn.Call("BlockStore.PutBlock", block, succ)
-	//panic("todo")
-	low := inst.LowerIndex
-	high := inst.UpperIndex
-	if (low < 0) {
-		low += bs.RingSize
-	}
-	if (high < 0) {
-		high += bs.RingSize
-	}
-	toDelete := make([]string, 0)
-	for k, v := range(bs.BlockMap) {
-		blockIdx := HashMod(k, bs.RingSize)
-		if (low <= high) {
-			if (blockIdx <= high && blockIdx >= low) {
-				e = conn.Call("BlockStore.PutBlock", v, succ)
-				if e != nil {
-					conn.Close()
-					return e
-				}
-				toDelete = append(toDelete, k)
+	hashes, e := bs.hashesInRange(inst.LowerIndex, inst.UpperIndex)
+	if e != nil {
+		return e
+	}
+	toDelete, _, e := bs.sendBlocks(inst.DestAddr, hashes, TransferOptions{})
+	if e != nil {
+		return e
+	}
+	if !inst.KeepSource {
+		for _, key := range toDelete {
+			if e = bs.Storage.Delete(key); e != nil {
+				return e
 			}
-		} else if (low > high) {
-			if ((blockIdx >= low && blockIdx < bs.RingSize) || blockIdx >= 0 && blockIdx <= high) {
-				e = conn.Call("BlockStore.PutBlock", v, succ)
-				if e != nil {
-					conn.Close()
-					return e
-				}
-				toDelete = append(toDelete, k)
+		}
+	}
+	*succ = true
+	return nil
+}
+
+// Drop the blocks with ring index between inst.LowerIndex and inst.UpperIndex
+// (in modulo sense) once this node no longer hosts that range. inst.DestAddr is ignored.
+func (bs *BlockStore) DeleteBlocks(inst MigrationInstruction, succ *bool) error {
+	hashes, e := bs.hashesInRange(inst.LowerIndex, inst.UpperIndex)
+	if e != nil {
+		return e
+	}
+	for _, k := range hashes {
+		if e = bs.Storage.Delete(k); e != nil {
+			return e
+		}
+	}
+	*succ = true
+	return nil
+}
+
+// List the blocks with ring index between inst.LowerIndex and inst.UpperIndex (in modulo sense). inst.DestAddr is ignored.
+func (bs *BlockStore) ListBlocks(inst MigrationInstruction, blockHashes *[]string) error {
+	hashes, e := bs.hashesInRange(inst.LowerIndex, inst.UpperIndex)
+	if e != nil {
+		return e
+	}
+	*blockHashes = hashes
+	return nil
+}
+
+// Copy the listed blocks held by this node to transfer.DestAddr. Blocks this node does not hold are skipped.
+func (bs *BlockStore) TransferBlocks(transfer BlockTransfer, succ *bool) error {
+	stats := TransferStats{}
+	if e := bs.CopyBlocks(transfer, &stats); e != nil {
+		return e
+	}
+	*succ = true
+	return nil
+}
+
+// Like TransferBlocks, and count the blocks and bytes actually sent
+func (bs *BlockStore) CopyBlocks(transfer BlockTransfer, stats *TransferStats) error {
+	sent, bytes, e := bs.sendBlocks(transfer.DestAddr, transfer.BlockHashes, transfer.Options)
+	*stats = TransferStats{Blocks: len(sent), Bytes: bytes}
+	return e
+}
+
+// Count the listed blocks held by this node and their bytes, as recorded by the
+// storage engine without reading the blocks. Blocks this node does not hold are skipped.
+func (bs *BlockStore) MeasureBlocks(blockHashes []string, stats *TransferStats) error {
+	for _, blockHash := range blockHashes {
+		size, exist, e := bs.Storage.Size(blockHash)
+		if e != nil {
+			return e
+		}
+		if exist {
+			stats.Blocks++
+			stats.Bytes += size
+		}
+	}
+	return nil
+}
+
+// Make PutBlock reject every block while this node is drained, or accept them again.
+// Copies from other BlockStores are still accepted.
+func (bs *BlockStore) SetReadOnly(readOnly bool, succ *bool) error {
+	bs.mtx.Lock()
+	bs.readOnly = readOnly
+	bs.mtx.Unlock()
+	*succ = true
+	return nil
+}
+
+// Drop the listed blocks from this node
+func (bs *BlockStore) DropBlocks(blockHashes []string, succ *bool) error {
+	for _, k := range blockHashes {
+		if e := bs.Storage.Delete(k); e != nil {
+			return e
+		}
+	}
+	*succ = true
+	return nil
+}
+
+// Check that this BlockStore hosts blockHash in the latest ring it knows, or in
+// the pending ring of a migration in progress. Without a ring, or with
+// bounded-load placement that may put a block anywhere, every block is accepted.
+func (bs *BlockStore) checkOwner(blockHash string) error {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	if bs.ring == nil || bs.SelfAddr == "" || bs.ring.LoadFactor > 0 {
+		return nil
+	}
+	rings := []*ConsistentHashRing{bs.ring}
+	if bs.pendingRing != nil {
+		rings = append(rings, bs.pendingRing)
+	}
+	for _, ring := range rings {
+		for _, host := range ring.FindBlockHosts(blockHash) {
+			if host.Addr == bs.SelfAddr {
+				return nil
 			}
 		}
 	}
-	for _, key := range(toDelete) {
-		delete(bs.BlockMap, key)
+	return WrongOwnerError{Addr: bs.SelfAddr, BlockHash: blockHash, Epoch: bs.ring.Epoch}
+}
+
+// Format of WrongOwnerError messages, which reach RPC clients as plain strings
+const wrongOwnerFormat = "wrong owner: BlockStore %s does not host block %s - new epoch is %d"
+
+// Returned by PutBlock and GetBlock when a client asks a BlockStore for a block it
+// does not host in ring Epoch, the latest ring it knows. The client routed the
+// call with a BlockStore map of an older ring and should get a new one and retry.
+type WrongOwnerError struct {
+	Addr      string
+	BlockHash string
+	Epoch     int
+}
+
+func (e WrongOwnerError) Error() string {
+	return fmt.Sprintf(wrongOwnerFormat, e.Addr, e.BlockHash, e.Epoch)
+}
+
+// Recover the WrongOwnerError behind an error returned by a BlockStore, locally or over RPC
+func ParseWrongOwnerError(e error) (WrongOwnerError, bool) {
+	if e == nil {
+		return WrongOwnerError{}, false
+	}
+	if wrongOwner, ok := e.(WrongOwnerError); ok {
+		return wrongOwner, true
+	}
+	wrongOwner := WrongOwnerError{}
+	if _, scanErr := fmt.Sscanf(e.Error(), wrongOwnerFormat, &wrongOwner.Addr, &wrongOwner.BlockHash, &wrongOwner.Epoch); scanErr != nil {
+		return WrongOwnerError{}, false
+	}
+	return wrongOwner, true
+}
+
+// Adopt a ring sent by the MetaStore or pulled from a peer, unless a newer one is
+// known already. A pending ring is only used to accept the blocks it places here,
+// one that is not newer than the current ring withdraws the pending change.
+// An invalid ring is rejected.
+func (bs *BlockStore) SetRing(update RingUpdate, succ *bool) error {
+	if e := update.Ring.Validate(); e != nil {
+		return fmt.Errorf("invalid ring: %v", e)
+	}
+	bs.mtx.Lock()
+	if update.SelfAddr != "" {
+		bs.SelfAddr = update.SelfAddr
+	}
+	if update.Pending {
+		if bs.ring == nil || update.Ring.Epoch > bs.ring.Epoch {
+			ring := update.Ring.Copy()
+			bs.pendingRing = &ring
+		} else {
+			bs.pendingRing = nil
+		}
+	} else if bs.ring == nil || update.Ring.Epoch >= bs.ring.Epoch {
+		ring := update.Ring.Copy()
+		bs.ring = &ring
+		bs.RingSize = ring.RingSize
+		if bs.pendingRing != nil && bs.pendingRing.Epoch <= ring.Epoch {
+			bs.pendingRing = nil
+		}
+	}
+	bs.mtx.Unlock()
+	bs.syncMembers()
+	*succ = true
+	return nil
+}
+
+// Get the latest ring known to this BlockStore
+func (bs *BlockStore) GetRing(succ bool, ring *ConsistentHashRing) error {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	if bs.ring == nil {
+		return fmt.Errorf("BlockStore has not received a ring yet")
 	}
-	// close the connection
-	return conn.Close()
+	*ring = bs.ring.Copy()
+	return nil
+}
+
+// Answer a health probe of the MetaStore
+func (bs *BlockStore) Ping(succ bool, alive *bool) error {
+	*alive = true
+	return nil
 }
 
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
 func NewBlockStore(ringSize int) BlockStore {
+	return NewBlockStoreWithStorage(ringSize, NewMemoryBlockStorage())
+}
+
+// Create a BlockStore backed by the given storage engine
+func NewBlockStoreWithStorage(ringSize int, storage BlockStorage) BlockStore {
 	return BlockStore{
-		BlockMap: map[string]Block{},
+		Storage:  storage,
 		RingSize: ringSize,
 	}
 }
+
+// Create a BlockStore whose blocks are persisted under blockDir.
+// Blocks already present in blockDir from a previous run are served again.
+func NewDiskBlockStore(ringSize int, blockDir string) (BlockStore, error) {
+	disk, e := NewDiskBlockStorage(blockDir)
+	if e != nil {
+		return BlockStore{}, e
+	}
+	return NewBlockStoreWithStorage(ringSize, disk), nil
+}
@@ -0,0 +1,237 @@
+package surfstore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Suffix of the temporary files written by writeFileAtomic before being renamed into place
+const tmpFileSuffix = ".tmp"
+
+// Number of index shards, one per h[:2] block directory
+const diskShardCount = 256
+
+// DiskBlockStorage keeps every block as a content-addressed file under Dir.
+// A block with hash h lives at Dir/h[:2]/h. Blocks are written to a temporary
+// file, synced and then renamed, so a crash never leaves a partial block behind.
+// The in-memory index (block hash -> block size) is rebuilt from Dir on startup.
+// The index is sharded like the directories, so disk I/O on one shard does
+// not block requests for blocks in the other shards.
+type DiskBlockStorage struct {
+	Dir    string
+	shards [diskShardCount]diskShard
+}
+
+// One h[:2] directory and the index of the blocks in it
+type diskShard struct {
+	mtx   sync.RWMutex
+	index map[string]int
+}
+
+// Open the block directory at dir, creating it if needed, and rebuild the index
+func NewDiskBlockStorage(dir string) (*DiskBlockStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &DiskBlockStorage{Dir: dir}
+	for i := range d.shards {
+		d.shards[i].index = map[string]int{}
+	}
+	if err := d.rebuildIndex(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Scan Dir for block files. Leftover temporary files from an interrupted
+// write are removed, anything else that is not named after a block hash is ignored.
+func (d *DiskBlockStorage) rebuildIndex() error {
+	return filepath.Walk(d.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if strings.HasSuffix(name, tmpFileSuffix) {
+			return os.Remove(path)
+		}
+		if !isBlockHash(name) || filepath.Base(filepath.Dir(path)) != name[:2] {
+			return nil
+		}
+		d.shard(name).index[name] = int(info.Size())
+		return nil
+	})
+}
+
+// Find the shard responsible for a (valid) block hash
+func (d *DiskBlockStorage) shard(blockHash string) *diskShard {
+	i, _ := strconv.ParseUint(blockHash[:2], 16, 8)
+	return &d.shards[i]
+}
+
+// Check that a string looks like a hex encoded SHA-256 block hash
+func isBlockHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func (d *DiskBlockStorage) blockPath(blockHash string) string {
+	return filepath.Join(d.Dir, blockHash[:2], blockHash)
+}
+
+// Read the block with the given hash. The bool result reports whether it exists.
+func (d *DiskBlockStorage) Get(blockHash string) (Block, bool, error) {
+	if !isBlockHash(blockHash) {
+		return Block{}, false, nil
+	}
+	shard := d.shard(blockHash)
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	if _, ok := shard.index[blockHash]; !ok {
+		return Block{}, false, nil
+	}
+	data, err := ioutil.ReadFile(d.blockPath(blockHash))
+	if err != nil {
+		return Block{}, false, err
+	}
+	return Block{BlockData: data, BlockSize: len(data)}, true, nil
+}
+
+// Durably store a block under the given hash
+func (d *DiskBlockStorage) Put(blockHash string, block Block) error {
+	if !isBlockHash(blockHash) {
+		return fmt.Errorf("invalid block hash %q", blockHash)
+	}
+	shard := d.shard(blockHash)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	if _, ok := shard.index[blockHash]; ok {
+		// content addressed, the block we have is identical
+		return nil
+	}
+
+	dir := filepath.Dir(d.blockPath(blockHash))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.blockPath(blockHash), block.BlockData); err != nil {
+		return err
+	}
+
+	shard.index[blockHash] = len(block.BlockData)
+	return nil
+}
+
+// Report whether a block with the given hash is stored
+func (d *DiskBlockStorage) Has(blockHash string) (bool, error) {
+	if !isBlockHash(blockHash) {
+		return false, nil
+	}
+	shard := d.shard(blockHash)
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	_, ok := shard.index[blockHash]
+	return ok, nil
+}
+
+// Get the size of a block from the index, without reading its file
+func (d *DiskBlockStorage) Size(blockHash string) (int, bool, error) {
+	if !isBlockHash(blockHash) {
+		return 0, false, nil
+	}
+	shard := d.shard(blockHash)
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	size, ok := shard.index[blockHash]
+	return size, ok, nil
+}
+
+// Remove the block with the given hash, if present
+func (d *DiskBlockStorage) Delete(blockHash string) error {
+	if !isBlockHash(blockHash) {
+		return nil
+	}
+	shard := d.shard(blockHash)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	if _, ok := shard.index[blockHash]; !ok {
+		return nil
+	}
+	if err := os.Remove(d.blockPath(blockHash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(shard.index, blockHash)
+	return nil
+}
+
+// Visit the stored blocks whose ring index lies in [lowerIndex, upperIndex] using the index only
+func (d *DiskBlockStorage) ForEachInRange(lowerIndex int, upperIndex int, ringSize int, fn func(blockHash string) error) error {
+	for i := range d.shards {
+		if err := d.shards[i].forEachInRange(lowerIndex, upperIndex, ringSize, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (shard *diskShard) forEachInRange(lowerIndex int, upperIndex int, ringSize int, fn func(blockHash string) error) error {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	for blockHash := range shard.index {
+		if !InRingRange(HashMod(blockHash, ringSize), lowerIndex, upperIndex, ringSize) {
+			continue
+		}
+		if err := fn(blockHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsync a directory so that a rename inside it survives a crash
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Replace path with data such that readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+"-*"+tmpFileSuffix)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(dir)
+}
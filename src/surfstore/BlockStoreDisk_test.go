@@ -0,0 +1,146 @@
+package surfstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Store n test blocks in storage and return their hashes
+func putTestBlocks(t *testing.T, storage BlockStorage, n int) []string {
+	t.Helper()
+	hashes := make([]string, n)
+	for i := range hashes {
+		block := testBlock(i)
+		hashes[i] = GetBlockHashString(block.BlockData)
+		if e := storage.Put(hashes[i], block); e != nil {
+			t.Fatal(e)
+		}
+	}
+	return hashes
+}
+
+// Sorted hashes ForEachInRange visits
+func hashesInRange(t *testing.T, storage BlockStorage, lowerIndex int, upperIndex int, ringSize int) []string {
+	t.Helper()
+	hashes := make([]string, 0)
+	e := storage.ForEachInRange(lowerIndex, upperIndex, ringSize, func(blockHash string) error {
+		hashes = append(hashes, blockHash)
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func TestDiskBlockStorageRebuildsIndexOnRestart(t *testing.T) {
+	dir := t.TempDir()
+	disk, e := NewDiskBlockStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	hashes := putTestBlocks(t, disk, 50)
+	if e := disk.Delete(hashes[0]); e != nil {
+		t.Fatal(e)
+	}
+
+	reopened, e := NewDiskBlockStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if has, _ := reopened.Has(hashes[0]); has {
+		t.Errorf("deleted block %s is back after the restart", hashes[0])
+	}
+	for i, blockHash := range hashes[1:] {
+		want := testBlock(i + 1)
+		block, exist, e := reopened.Get(blockHash)
+		if e != nil || !exist {
+			t.Fatalf("block %s lost after the restart: %v", blockHash, e)
+		}
+		if string(block.BlockData) != string(want.BlockData) {
+			t.Errorf("block %s is %q, want %q", blockHash, block.BlockData, want.BlockData)
+		}
+		if size, _, _ := reopened.Size(blockHash); size != want.BlockSize {
+			t.Errorf("block %s has size %d in the index, want %d", blockHash, size, want.BlockSize)
+		}
+	}
+}
+
+func TestDiskBlockStorageIgnoresPartialBlockFiles(t *testing.T) {
+	dir := t.TempDir()
+	disk, e := NewDiskBlockStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	stored := putTestBlocks(t, disk, 1)[0]
+
+	// a crash between the write and the rename leaves a temporary file behind
+	partial := GetBlockHashString(testBlock(1).BlockData)
+	tmpPath := filepath.Join(dir, partial[:2], partial+"-123"+tmpFileSuffix)
+	if e := os.MkdirAll(filepath.Dir(tmpPath), 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(tmpPath, []byte("bloc"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	// files not named after their hash, or in the wrong directory, are not blocks
+	if e := ioutil.WriteFile(filepath.Join(dir, stored[:2], "notes.txt"), []byte("x"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(filepath.Join(dir, partial), []byte("x"), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	reopened, e := NewDiskBlockStorage(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if has, _ := reopened.Has(partial); has {
+		t.Errorf("partially written block %s is indexed", partial)
+	}
+	if _, e := os.Stat(tmpPath); !os.IsNotExist(e) {
+		t.Errorf("temporary file %s was not removed: %v", tmpPath, e)
+	}
+	if got := hashesInRange(t, reopened, 0, 127, 128); len(got) != 1 || got[0] != stored {
+		t.Errorf("index holds %v, want [%s]", got, stored)
+	}
+}
+
+func TestDiskBlockStorageForEachInRangeMatchesMemory(t *testing.T) {
+	disk, e := NewDiskBlockStorage(t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	memory := NewMemoryBlockStorage()
+	putTestBlocks(t, disk, 300)
+	putTestBlocks(t, memory, 300)
+
+	ranges := []struct {
+		name                   string
+		lowerIndex, upperIndex int
+	}{
+		{"whole ring", 0, 127},
+		{"single index", 42, 42},
+		{"lower half", 0, 63},
+		{"wrapping", 120, 7},
+		{"upper end", 100, 127},
+	}
+	for _, r := range ranges {
+		t.Run(r.name, func(t *testing.T) {
+			want := hashesInRange(t, memory, r.lowerIndex, r.upperIndex, 128)
+			got := hashesInRange(t, disk, r.lowerIndex, r.upperIndex, 128)
+			if len(got) != len(want) {
+				t.Fatalf("disk visits %d blocks, memory %d", len(got), len(want))
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("disk visits %s where memory visits %s", got[i], want[i])
+				}
+			}
+		})
+	}
+}
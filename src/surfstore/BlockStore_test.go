@@ -0,0 +1,191 @@
+package surfstore
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+// Start n BlockStores serving RPCs on free localhost ports
+func startBlockStores(t *testing.T, n int, ringSize int) ([]string, []*BlockStore) {
+	t.Helper()
+	addrs := make([]string, n)
+	stores := make([]*BlockStore, n)
+	for i := 0; i < n; i++ {
+		store := NewBlockStore(ringSize)
+		stores[i] = &store
+		server := rpc.NewServer()
+		if e := server.RegisterName("BlockStore", stores[i]); e != nil {
+			t.Fatal(e)
+		}
+		l, e := net.Listen("tcp", "localhost:0")
+		if e != nil {
+			t.Fatal(e)
+		}
+		t.Cleanup(func() { l.Close() })
+		go http.Serve(l, server)
+		addrs[i] = l.Addr().String()
+	}
+	return addrs, stores
+}
+
+func testBlock(i int) Block {
+	data := []byte(fmt.Sprintf("block %d", i))
+	return Block{BlockData: data, BlockSize: len(data)}
+}
+
+// PutBlock, GetBlock, HasBlocks and the range scans used by migrations all run
+// at once on one BlockStore, as net/rpc serves them
+func TestBlockStoreConcurrentPutBlock(t *testing.T) {
+	const workers = 8
+	const blocksPerWorker = 200
+	store := NewBlockStore(128)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < blocksPerWorker; i++ {
+				block := testBlock(w*blocksPerWorker + i)
+				succ := false
+				if e := store.PutBlock(block, &succ); e != nil || !succ {
+					t.Errorf("PutBlock: %v", e)
+					return
+				}
+				var got Block
+				if e := store.GetBlock(GetBlockHashString(block.BlockData), &got); e != nil {
+					t.Errorf("GetBlock: %v", e)
+					return
+				}
+				if string(got.BlockData) != string(block.BlockData) {
+					t.Errorf("GetBlock returned %q, want %q", got.BlockData, block.BlockData)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				hashes := make([]string, 0)
+				if e := store.ListBlocks(MigrationInstruction{LowerIndex: 0, UpperIndex: 127}, &hashes); e != nil {
+					t.Errorf("ListBlocks: %v", e)
+					return
+				}
+				held := make([]string, 0)
+				if e := store.HasBlocks(hashes, &held); e != nil {
+					t.Errorf("HasBlocks: %v", e)
+					return
+				}
+				trees := make([]MerkleTree, 0)
+				if e := store.GetMerkleTrees([]MerkleRange{{LowerIndex: 0, UpperIndex: 63, RingSize: 128}}, &trees); e != nil {
+					t.Errorf("GetMerkleTrees: %v", e)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	hashes := make([]string, 0)
+	if e := store.ListBlocks(MigrationInstruction{LowerIndex: 0, UpperIndex: 127}, &hashes); e != nil {
+		t.Fatal(e)
+	}
+	if len(hashes) != workers*blocksPerWorker {
+		t.Fatalf("BlockStore holds %d blocks, want %d", len(hashes), workers*blocksPerWorker)
+	}
+}
+
+// Blocks are copied away from a BlockStore while clients keep storing new ones
+func TestBlockStoreConcurrentPutBlockDuringMigration(t *testing.T) {
+	addrs, stores := startBlockStores(t, 2, 128)
+	src, dest := stores[0], stores[1]
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				succ := false
+				if e := src.PutBlock(testBlock(w*200+i), &succ); e != nil {
+					t.Errorf("PutBlock: %v", e)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			succ := false
+			inst := MigrationInstruction{LowerIndex: 0, UpperIndex: 127, DestAddr: addrs[1], KeepSource: true}
+			if e := src.MigrateBlocks(inst, &succ); e != nil {
+				t.Errorf("MigrateBlocks: %v", e)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// a last copy picks up the blocks stored after the previous one
+	succ := false
+	if e := src.MigrateBlocks(MigrationInstruction{LowerIndex: 0, UpperIndex: 127, DestAddr: addrs[1], KeepSource: true}, &succ); e != nil {
+		t.Fatal(e)
+	}
+	held := make([]string, 0)
+	if e := dest.ListBlocks(MigrationInstruction{LowerIndex: 0, UpperIndex: 127}, &held); e != nil {
+		t.Fatal(e)
+	}
+	if len(held) != 800 {
+		t.Fatalf("destination holds %d blocks, want 800", len(held))
+	}
+}
+
+func TestWrongOwnerErrorSurvivesRPC(t *testing.T) {
+	addrs, stores := startBlockStores(t, 2, 128)
+	ring := NewConsistentHashRing(128, addrs)
+	ring.Epoch = 3
+	for i, store := range stores {
+		succ := false
+		if e := store.SetRing(RingUpdate{Ring: ring, SelfAddr: addrs[i]}, &succ); e != nil {
+			t.Fatal(e)
+		}
+	}
+	var block Block
+	for i := 0; ; i++ {
+		if block = testBlock(i); ring.FindBlockHosts(GetBlockHashString(block.BlockData))[0].Addr == addrs[1] {
+			break
+		}
+	}
+	want := WrongOwnerError{Addr: addrs[0], BlockHash: GetBlockHashString(block.BlockData), Epoch: 3}
+
+	succ := false
+	local := stores[0].PutBlock(block, &succ)
+	remote := rpcCall(addrs[0], "BlockStore.PutBlock", block, &succ)
+	for _, e := range []error{local, remote} {
+		if wrongOwner, ok := ParseWrongOwnerError(e); !ok || wrongOwner != want {
+			t.Errorf("parsed %v from %v, want %v", wrongOwner, e, want)
+		}
+	}
+	for _, e := range []error{nil, fmt.Errorf("disk full"), fmt.Errorf("wrong owner: unexpected")} {
+		if _, ok := ParseWrongOwnerError(e); ok {
+			t.Errorf("%v parsed as a wrong owner error", e)
+		}
+	}
+
+	// a BlockStore never goes back to an older ring
+	older := ring.Copy()
+	older.Epoch = 2
+	if e := stores[0].SetRing(RingUpdate{Ring: older}, &succ); e != nil {
+		t.Fatal(e)
+	}
+	current := ConsistentHashRing{}
+	if e := stores[0].GetRing(true, &current); e != nil || current.Epoch != 3 {
+		t.Errorf("BlockStore ring is at epoch %d (%v) after an older ring was sent, want 3", current.Epoch, e)
+	}
+}
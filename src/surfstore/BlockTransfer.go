@@ -0,0 +1,144 @@
+package surfstore
+
+import (
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Size of a batch of blocks sent in one ReplicateBlocks call when TransferOptions.BatchBytes is 0
+const DefaultTransferBatchBytes = 4 << 20
+
+// Fill in the defaults of the unset options
+func (options TransferOptions) withDefaults() TransferOptions {
+	if options.BatchBytes <= 0 {
+		options.BatchBytes = DefaultTransferBatchBytes
+	}
+	if options.Parallelism <= 0 {
+		options.Parallelism = 1
+	}
+	return options
+}
+
+// Blocks sent together in one ReplicateBlocks call
+type blockBatch struct {
+	hashes []string
+	blocks []Block
+	bytes  int
+}
+
+// Copy the listed blocks held here to destAddr in batches of about
+// options.BatchBytes, over options.Parallelism connections and at no more than
+// options.BytesPerSecond. Blocks this BlockStore does not hold are skipped.
+// Returns the hashes of the blocks that were copied, which are all of the held
+// ones unless an error is returned, and their total size in bytes.
+func (bs *BlockStore) sendBlocks(destAddr string, blockHashes []string, options TransferOptions) ([]string, int, error) {
+	options = options.withDefaults()
+	limiter := &throttle{rate: options.BytesPerSecond}
+	batches := make(chan blockBatch)
+
+	var mtx sync.Mutex
+	sent := make([]string, 0, len(blockHashes))
+	sentBytes := 0
+	var firstErr error
+	failed := make(chan struct{})
+	fail := func(e error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if firstErr == nil {
+			firstErr = e
+			close(failed)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < options.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, e := rpc.DialHTTP("tcp", destAddr)
+			if e != nil {
+				fail(e)
+				return
+			}
+			defer conn.Close()
+			for batch := range batches {
+				limiter.wait(batch.bytes)
+				succ := false
+				if e := conn.Call("BlockStore.ReplicateBlocks", batch.blocks, &succ); e != nil {
+					fail(e)
+					return
+				}
+				mtx.Lock()
+				sent = append(sent, batch.hashes...)
+				sentBytes += batch.bytes
+				mtx.Unlock()
+			}
+		}()
+	}
+
+	// read the blocks and hand out batches until every worker failed or all are sent
+	emit := func(batch blockBatch) bool {
+		select {
+		case batches <- batch:
+			return true
+		case <-failed:
+			return false
+		}
+	}
+	batch := blockBatch{}
+	for _, blockHash := range blockHashes {
+		block, exist, e := bs.Storage.Get(blockHash)
+		if e != nil {
+			fail(e)
+			break
+		}
+		if !exist {
+			continue
+		}
+		if len(batch.blocks) > 0 && batch.bytes+len(block.BlockData) > options.BatchBytes {
+			if !emit(batch) {
+				break
+			}
+			batch = blockBatch{}
+		}
+		batch.hashes = append(batch.hashes, blockHash)
+		batch.blocks = append(batch.blocks, block)
+		batch.bytes += len(block.BlockData)
+	}
+	if len(batch.blocks) > 0 {
+		emit(batch)
+	}
+	close(batches)
+	wg.Wait()
+	// take the time of the last batch too, so that back to back calls keep to the rate
+	limiter.wait(0)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	return sent, sentBytes, firstErr
+}
+
+// Spaces out transfers so that they average at most rate bytes per second, 0 means unlimited
+type throttle struct {
+	rate int
+
+	mtx  sync.Mutex
+	next time.Time
+}
+
+// Wait until bytes more can be sent
+func (t *throttle) wait(bytes int) {
+	if t.rate <= 0 {
+		return
+	}
+	t.mtx.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	start := t.next
+	t.next = t.next.Add(time.Duration(float64(bytes) / float64(t.rate) * float64(time.Second)))
+	t.mtx.Unlock()
+	time.Sleep(time.Until(start))
+}
@@ -0,0 +1,102 @@
+package surfstore
+
+import (
+	"math"
+)
+
+// Bounded-load placement (Mirrokni et al., "Consistent Hashing with Bounded Loads").
+// When LoadFactor (epsilon) is set, a new block is not necessarily placed on
+// its natural replica set: every BlockStore may host at most
+// ceil((1 + epsilon) * average load) blocks, scaled by its weight, and a block
+// whose natural hosts are full spills over to the next hosts in the placement
+// order. The MetaStore records the replica sets of spilled blocks (block hash ->
+// addresses) next to the ring, not in it, so that lookups still find them.
+
+// Find the natural replica set of a block, the hosts of its ring index
+func (ms *ConsistentHashRing) FindBlockHosts(blockHash string) []Node {
+	return ms.FindHostingNodes(ms.ComputeBlockIndex(blockHash))
+}
+
+// Find the replica set of a block: the nodes it spilled to, or else its natural hosts in ring
+func findPlacedHosts(ring *ConsistentHashRing, spills map[string][]string, blockHash string) []Node {
+	if addrs, ok := spills[blockHash]; ok {
+		hosts := make([]Node, len(addrs))
+		for i, addr := range addrs {
+			hosts[i] = ring.firstNode(addr)
+		}
+		return hosts
+	}
+	return ring.FindBlockHosts(blockHash)
+}
+
+// Choose the replica set of a new block given the current number of blocks per address.
+// Candidates are taken in placement order starting at the block's ring index and
+// skipped while they are at capacity. The bool result reports whether the block
+// spilled, i.e. whether the chosen set differs from its natural hosts.
+func (ms *ConsistentHashRing) PlaceBlock(blockHash string, loads map[string]int) ([]Node, bool) {
+	ringIndex := ms.ComputeBlockIndex(blockHash)
+	natural := ms.FindHostingNodes(ringIndex)
+	if ms.LoadFactor <= 0 {
+		return natural, false
+	}
+
+	members := ms.members()
+	totalWeight := 0
+	for _, weight := range members {
+		totalWeight += weight
+	}
+	total := len(natural)
+	for _, load := range loads {
+		total += load
+	}
+
+	hosts := make([]Node, 0, len(natural))
+	for _, node := range ms.findHostingNodes(ringIndex, len(members)) {
+		capacity := int(math.Ceil((1 + ms.LoadFactor) * float64(total) * float64(members[node.Addr]) / float64(totalWeight)))
+		if loads[node.Addr] >= capacity {
+			continue
+		}
+		hosts = append(hosts, node)
+		if len(hosts) == len(natural) {
+			break
+		}
+	}
+	if len(hosts) < len(natural) {
+		// cannot happen as the capacities add up to more than the total, but never fail a lookup
+		return natural, false
+	}
+
+	for i := range hosts {
+		if hosts[i].Addr != natural[i].Addr {
+			return hosts, true
+		}
+	}
+	return natural, false
+}
+
+// Copy a map of spilled blocks to their hosts, so it can be modified independently
+func copySpills(spills map[string][]string) map[string][]string {
+	spillsCopy := make(map[string][]string, len(spills))
+	for blockHash, addrs := range spills {
+		spillsCopy[blockHash] = append([]string(nil), addrs...)
+	}
+	return spillsCopy
+}
+
+// Empty a map of spilled blocks, as a ring change moves them to their natural hosts
+func clearSpills(spills map[string][]string) {
+	for blockHash := range spills {
+		delete(spills, blockHash)
+	}
+}
+
+// Count the blocks hosted per address for the given block hashes, some of which spilled
+func (ms *ConsistentHashRing) CountLoads(blockHashes map[string]bool, spills map[string][]string) map[string]int {
+	loads := make(map[string]int)
+	for blockHash := range blockHashes {
+		for _, node := range findPlacedHosts(ms, spills, blockHash) {
+			loads[node.Addr]++
+		}
+	}
+	return loads
+}
@@ -0,0 +1,134 @@
+package surfstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func boundedRing(loadFactor float64) ConsistentHashRing {
+	ring := NewConsistentHashRing(128, testAddrs(2))
+	ring.LoadFactor = loadFactor
+	return ring
+}
+
+// Hashes of n test blocks whose natural host in ring is addr
+func blocksHostedBy(ring *ConsistentHashRing, addr string, n int) []string {
+	hashes := make([]string, 0, n)
+	for i := 0; len(hashes) < n; i++ {
+		hash := GetBlockHashString(testBlock(i).BlockData)
+		if ring.FindBlockHosts(hash)[0].Addr == addr {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+func TestPlaceBlockSpillsOffFullHosts(t *testing.T) {
+	addrs := testAddrs(2)
+	tests := []struct {
+		name       string
+		loadFactor float64
+		loads      map[string]int
+		want       string
+		spilled    bool
+	}{
+		{"disabled", 0, map[string]int{addrs[0]: 100}, addrs[0], false},
+		{"below capacity", 0.25, map[string]int{addrs[0]: 5, addrs[1]: 5}, addrs[0], false},
+		{"natural host full", 0.25, map[string]int{addrs[0]: 10}, addrs[1], true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ring := boundedRing(test.loadFactor)
+			hash := blocksHostedBy(&ring, addrs[0], 1)[0]
+			hosts, spilled := ring.PlaceBlock(hash, test.loads)
+			if spilled != test.spilled || len(hosts) != 1 || hosts[0].Addr != test.want {
+				t.Errorf("placed on %v (spilled %v), want %s (spilled %v)", nodeAddrs(hosts), spilled, test.want, test.spilled)
+			}
+		})
+	}
+}
+
+func placedHost(t *testing.T, store *MetaStore, hash string) string {
+	t.Helper()
+	blockStoreMap := make(map[string][]string)
+	if e := store.GetBlockStoreMap([]string{hash}, &blockStoreMap); e != nil {
+		t.Fatal(e)
+	}
+	if len(blockStoreMap) != 1 {
+		t.Fatalf("block %s placed on %v, want one BlockStore", hash, blockStoreMap)
+	}
+	for addr := range blockStoreMap {
+		return addr
+	}
+	return ""
+}
+
+func TestBoundedLoadCountsOnlyCommittedBlocks(t *testing.T) {
+	addrs := testAddrs(2)
+	dir := t.TempDir()
+	ring := boundedRing(0.25)
+	store, e := NewPersistentMetaStore(ring, dir, 1000)
+	if e != nil {
+		t.Fatal(e)
+	}
+	full := blocksHostedBy(&ring, addrs[0], 21)
+
+	// blocks that are only asked for never fill a BlockStore
+	for _, hash := range full[:20] {
+		if addr := placedHost(t, &store, hash); addr != addrs[0] {
+			t.Fatalf("block %s spilled to %s before anything was stored", hash, addr)
+		}
+	}
+	for addr, load := range store.blockLoads {
+		if load != 0 {
+			t.Fatalf("%s has load %d before any file was stored", addr, load)
+		}
+	}
+
+	latestVersion := 0
+	if e := store.UpdateFile(&FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: full[:20]}, &latestVersion); e != nil {
+		t.Fatal(e)
+	}
+	if want := map[string]int{addrs[0]: 20}; !reflect.DeepEqual(store.blockLoads, want) {
+		t.Fatalf("loads are %v, want %v", store.blockLoads, want)
+	}
+
+	// the next block of the full BlockStore spills, and stays where it spilled
+	spilled := full[20]
+	if addr := placedHost(t, &store, spilled); addr != addrs[1] {
+		t.Fatalf("block %s placed on %s, want it spilled to %s", spilled, addr, addrs[1])
+	}
+	if addr := placedHost(t, &store, spilled); addr != addrs[1] {
+		t.Fatalf("spilled block %s moved to %s", spilled, addr)
+	}
+	store.Log.Close()
+
+	recovered, e := NewPersistentMetaStore(ring, dir, 1000)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer recovered.Log.Close()
+	if addr := placedHost(t, &recovered, spilled); addr != addrs[1] {
+		t.Fatalf("spilled block %s found on %s after a restart, want %s", spilled, addr, addrs[1])
+	}
+}
+
+func TestRingChangeMovesSpilledBlocks(t *testing.T) {
+	addrs := testAddrs(3)
+	oldRing := boundedRing(0.25)
+	spilled := blocksHostedBy(&oldRing, addrs[0], 1)[0]
+	spills := map[string][]string{spilled: {addrs[1]}}
+
+	newRing := oldRing.Copy()
+	if e := newRing.AddNode(addrs[2]); e != nil {
+		t.Fatal(e)
+	}
+	plan := PlanMigrationAvoiding(&oldRing, &newRing, spills, nil)
+	natural := newRing.FindBlockHosts(spilled)[0].Addr
+	if len(plan.BlockCopies) != 1 || plan.BlockCopies[0].SrcAddr != addrs[1] || plan.BlockCopies[0].Transfer.DestAddr != natural {
+		t.Errorf("spilled block copies %+v, want one from %s to %s", plan.BlockCopies, addrs[1], natural)
+	}
+	if len(plan.BlockDeletes) != 1 || plan.BlockDeletes[0].SrcAddr != addrs[1] {
+		t.Errorf("spilled block deletes %+v, want one from %s", plan.BlockDeletes, addrs[1])
+	}
+}
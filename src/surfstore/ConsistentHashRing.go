@@ -3,18 +3,36 @@ package surfstore
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"math/big"
 	"sort"
+	"strconv"
+	"strings"
 )
 
+// A (virtual) node on the ring. A BlockStore address owns Tokens * Weight Nodes.
 type Node struct {
-	Addr  string
-	Index int
+	Addr   string
+	Index  int
+	Token  int
+	Weight int
 }
 
 type ConsistentHashRing struct {
 	RingSize int
 	Nodes    []Node
+	// Number of distinct BlockStores holding a copy of each block, 0 is treated as 1
+	Replicas int
+	// Number of virtual nodes placed on the ring per BlockStore address, 0 is treated as 1
+	Tokens int
+	// Name of the PlacementStrategy deciding which nodes host a ring index, "" is the classic ring
+	Placement string
+	// Lookup table precomputed by the placement strategy, if it needs one
+	Lookup []string
+	// Epsilon of bounded-load placement, 0 disables it (see BoundedLoad.go)
+	LoadFactor float64
+	// Incremented by the MetaStore on every membership change or resize
+	Epoch int
 }
 
 // Perform a modulo operation on a hash string.
@@ -29,6 +47,21 @@ func HashMod(hashString string, ringSize int) int {
 	return int(indexInt.Int64())
 }
 
+// Check whether ringIndex lies in [lowerIndex, upperIndex] in a modulo sense.
+// The range wraps around the end of the ring when lowerIndex > upperIndex.
+func InRingRange(ringIndex int, lowerIndex int, upperIndex int, ringSize int) bool {
+	if lowerIndex < 0 {
+		lowerIndex += ringSize
+	}
+	if upperIndex < 0 {
+		upperIndex += ringSize
+	}
+	if lowerIndex <= upperIndex {
+		return ringIndex >= lowerIndex && ringIndex <= upperIndex
+	}
+	return ringIndex >= lowerIndex || ringIndex <= upperIndex
+}
+
 // Compute a block’s index on the ring from its hash value.
 func (ms *ConsistentHashRing) ComputeBlockIndex(blockHash string) int {
 	return HashMod(blockHash, ms.RingSize)
@@ -41,101 +74,378 @@ func (ms *ConsistentHashRing) ComputeNodeIndex(nodeAddr string) int {
 	return HashMod(hashString, ms.RingSize)
 }
 
-// Find the hosting node for the given ringIndex. It’s basically the first node on the ring with node.Index >= ringIndex (in a modulo sense).
+// Compute the ring index of the given virtual node of nodeAddr.
+// Token 0 sits at ComputeNodeIndex(nodeAddr), token t > 0 at the hash of "nodeAddr#t".
+func (ms *ConsistentHashRing) ComputeVirtualNodeIndex(nodeAddr string, token int) int {
+	if token == 0 {
+		return ms.ComputeNodeIndex(nodeAddr)
+	}
+	return ms.ComputeNodeIndex(nodeAddr + "#" + strconv.Itoa(token))
+}
+
+// Number of virtual nodes per address
+func (ms *ConsistentHashRing) tokenCount() int {
+	if ms.Tokens < 1 {
+		return 1
+	}
+	return ms.Tokens
+}
+
+// Find the hosting node for the given ringIndex. With the classic ring it’s basically the first node on the ring with node.Index >= ringIndex (in a modulo sense).
 func (ms *ConsistentHashRing) FindHostingNode(ringIndex int) Node {
-	// Try to implement a O(log N) solution here using binary search.
-	// It's also fine if you can't because we don't test your perforrmance.
-	//panic("todo")
-	end := len(ms.Nodes) - 1
-	start := 0
-	// if block index is in between the first and last node, use first node
-	if (ringIndex > ms.Nodes[end].Index) {
-		return ms.Nodes[0]
-	}
-	// else find the node in linear sense
-	bestDistance := ms.Nodes[end].Index - ringIndex
-	successorNode := ms.Nodes[end]
-	for {
-		if (start > end) {
-			break
+	return ms.findHostingNodes(ringIndex, 1)[0]
+}
+
+// Find the replica set for the given ringIndex: up to Replicas nodes with
+// distinct addresses as chosen by the placement strategy, hosting node first.
+// With the classic ring these are the hosting node and the next nodes clockwise.
+func (ms *ConsistentHashRing) FindHostingNodes(ringIndex int) []Node {
+	replicas := ms.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+	return ms.findHostingNodes(ringIndex, replicas)
+}
+
+func (ms *ConsistentHashRing) findHostingNodes(ringIndex int, replicas int) []Node {
+	strategy, e := GetPlacementStrategy(ms.Placement)
+	if e != nil {
+		// rings received over RPC are checked with Validate, fall back to the classic ring otherwise
+		strategy = consistentHashPlacement{}
+	}
+	return strategy.Locate(ms, ringIndex, replicas)
+}
+
+// Check a ring received over RPC or read from disk before using it: the
+// placement strategy must be known and every node and lookup entry must fit the ring
+func (ms *ConsistentHashRing) Validate() error {
+	if ms.RingSize < 1 {
+		return fmt.Errorf("invalid ring size %d", ms.RingSize)
+	}
+	if _, e := GetPlacementStrategy(ms.Placement); e != nil {
+		return e
+	}
+	members := make(map[string]bool, len(ms.Nodes))
+	for _, node := range ms.Nodes {
+		if node.Addr == "" || node.Index < 0 || node.Index >= ms.RingSize {
+			return fmt.Errorf("invalid node %+v on a ring of size %d", node, ms.RingSize)
+		}
+		members[node.Addr] = true
+	}
+	for _, addr := range ms.Lookup {
+		if !members[addr] {
+			return fmt.Errorf("lookup entry %s is not a node of the ring", addr)
+		}
+	}
+	return nil
+}
+
+// Switch the ring to the named placement strategy
+func (ms *ConsistentHashRing) SetPlacement(placement string) error {
+	if _, e := GetPlacementStrategy(placement); e != nil {
+		return e
+	}
+	oldPlacement := ms.Placement
+	ms.Placement = placement
+	if e := ms.placeNodes(ms.members()); e != nil {
+		ms.Placement = oldPlacement
+		return e
+	}
+	return nil
+}
+
+// Position in Nodes of the first node with node.Index >= ringIndex, wrapping to 0.
+// Nodes are sorted by Index, so this is a binary search.
+func (ms *ConsistentHashRing) successorPosition(ringIndex int) int {
+	pos := sort.Search(len(ms.Nodes), func(i int) bool {
+		return ms.Nodes[i].Index >= ringIndex
+	})
+	if pos == len(ms.Nodes) {
+		return 0
+	}
+	return pos
+}
+
+// Add the given nodeAddr to the ring, with one virtual node per token.
+func (ms *ConsistentHashRing) AddNode(nodeAddr string) error {
+	return ms.AddWeightedNode(nodeAddr, 1)
+}
+
+// Add the given nodeAddr to the ring with weight times as many virtual nodes as a node of weight 1.
+// Tokens are numbered from 0, so changing the weight of a node keeps the positions of its first tokens.
+func (ms *ConsistentHashRing) AddWeightedNode(nodeAddr string, weight int) error {
+	members := ms.members()
+	if _, exist := members[nodeAddr]; exist {
+		return fmt.Errorf("BlockStore %s is already in the ring", nodeAddr)
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	members[nodeAddr] = weight
+	return ms.placeNodes(members)
+}
+
+// Remove all virtual nodes of the given nodeAddr from the ring.
+// Nodes that had been moved off their index by a collision with nodeAddr move back.
+func (ms *ConsistentHashRing) RemoveNode(nodeAddr string) error {
+	members := ms.members()
+	if _, exist := members[nodeAddr]; !exist {
+		return fmt.Errorf("BlockStore %s is not in the ring", nodeAddr)
+	}
+	delete(members, nodeAddr)
+	return ms.placeNodes(members)
+}
+
+// Change the weight of nodeAddr, adding or removing its highest tokens
+func (ms *ConsistentHashRing) ReweightNode(nodeAddr string, weight int) error {
+	members := ms.members()
+	if _, exist := members[nodeAddr]; !exist {
+		return fmt.Errorf("BlockStore %s is not in the ring", nodeAddr)
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	members[nodeAddr] = weight
+	return ms.placeNodes(members)
+}
+
+// Change the size of the ring and recompute the index of every virtual node
+func (ms *ConsistentHashRing) Resize(ringSize int) error {
+	if ringSize < 1 {
+		return fmt.Errorf("invalid ring size %d", ringSize)
+	}
+	members := ms.members()
+	oldSize := ms.RingSize
+	ms.RingSize = ringSize
+	if e := ms.placeNodes(members); e != nil {
+		ms.RingSize = oldSize
+		return e
+	}
+	return nil
+}
+
+// Get the weight of nodeAddr, 0 if it is not on the ring
+func (ms *ConsistentHashRing) NodeWeight(nodeAddr string) int {
+	return ms.members()[nodeAddr]
+}
+
+// List the BlockStore addresses on the ring, sorted
+func (ms *ConsistentHashRing) Addrs() []string {
+	addrs := make([]string, 0)
+	for addr := range ms.members() {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// A maximal run of ring indices [LowerIndex, UpperIndex] hosted by the same
+// replica set. The run wraps around the end of the ring when LowerIndex > UpperIndex.
+type RingRange struct {
+	LowerIndex int
+	UpperIndex int
+	Hosts      []string
+}
+
+// Split the ring into the ranges hosted by the same replica set, in ring order.
+// A range ending at the top of the ring is joined with one starting at 0.
+func (ms *ConsistentHashRing) Ranges() []RingRange {
+	ranges := make([]RingRange, 0)
+	if len(ms.Nodes) == 0 {
+		return ranges
+	}
+	for ringIndex := 0; ringIndex < ms.RingSize; ringIndex++ {
+		hosts := nodeAddrs(ms.FindHostingNodes(ringIndex))
+		last := len(ranges) - 1
+		if last >= 0 && sameAddrs(ranges[last].Hosts, hosts) {
+			ranges[last].UpperIndex = ringIndex
+			continue
 		}
-		middle := (end - start) / 2
-		middle += start
-		middleNode := ms.Nodes[middle]
-		distance := middleNode.Index - ringIndex
-		if (distance < 0) {
-			start = middle + 1
+		ranges = append(ranges, RingRange{LowerIndex: ringIndex, UpperIndex: ringIndex, Hosts: hosts})
+	}
+	last := len(ranges) - 1
+	if last > 0 && sameAddrs(ranges[0].Hosts, ranges[last].Hosts) {
+		ranges[0].LowerIndex = ranges[last].LowerIndex
+		ranges = ranges[:last]
+	}
+	return ranges
+}
+
+// Describe the ring: its settings and every virtual node in ring order, with
+// the index it hashes to and the ranges of ring indices it is the hosting node of. A range ending at the
+// top of the ring is joined with one of the same node starting at 0.
+func (ms *ConsistentHashRing) Info() RingInfo {
+	info := RingInfo{
+		RingSize:  ms.RingSize,
+		Epoch:     ms.Epoch,
+		Replicas:  ms.Replicas,
+		Placement: ms.Placement,
+		Nodes:     make([]RingNodeInfo, len(ms.Nodes)),
+	}
+	// position of each virtual node in Nodes, by "address#token"
+	position := make(map[string]int, len(ms.Nodes))
+	for i, node := range ms.Nodes {
+		info.Nodes[i] = RingNodeInfo{Node: node, HashedIndex: ms.ComputeVirtualNodeIndex(node.Addr, node.Token), Ranges: make([]IndexRange, 0)}
+		position[fmt.Sprintf("%s#%d", node.Addr, node.Token)] = i
+	}
+	if len(ms.Nodes) == 0 {
+		return info
+	}
+
+	// runs of ring indices with the same hosting node, and the node of each
+	runs := make([]IndexRange, 0)
+	owners := make([]int, 0)
+	for ringIndex := 0; ringIndex < ms.RingSize; ringIndex++ {
+		host := ms.FindHostingNode(ringIndex)
+		owner := position[fmt.Sprintf("%s#%d", host.Addr, host.Token)]
+		last := len(runs) - 1
+		if last >= 0 && owners[last] == owner {
+			runs[last].UpperIndex = ringIndex
 			continue
-		} else {
-			end = middle - 1
 		}
-		if (distance < bestDistance) {
-			bestDistance = distance
-			successorNode = middleNode
+		runs = append(runs, IndexRange{LowerIndex: ringIndex, UpperIndex: ringIndex})
+		owners = append(owners, owner)
+	}
+	last := len(runs) - 1
+	if last > 0 && owners[0] == owners[last] {
+		runs[0].LowerIndex = runs[last].LowerIndex
+		runs = runs[:last]
+	}
+	for i, run := range runs {
+		nodeInfo := &info.Nodes[owners[i]]
+		nodeInfo.Ranges = append(nodeInfo.Ranges, run)
+		nodeInfo.Owned += (run.UpperIndex-run.LowerIndex+ms.RingSize)%ms.RingSize + 1
+	}
+	return info
+}
+
+func sameAddrs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
-	return successorNode
+	return true
 }
 
-// Add the given nodeAddr to the ring.
-func (ms *ConsistentHashRing) AddNode(nodeAddr string) {
-	// O(N) solution is totally fine here.
-	// O(log N) solution might be overly complicated.
-	//panic("todo")
-	nodeIdx := ms.ComputeNodeIndex(nodeAddr)
-	newNode := Node{Index: nodeIdx, Addr: nodeAddr}
-	ms.Nodes = append(ms.Nodes, newNode)
-	sort.Slice(ms.Nodes, func(i, j int) bool { 
-		return ms.Nodes[i].Index < ms.Nodes[j].Index 
-	})
+// A virtual node that collided with another node and was moved off the index its hash maps to
+type Collision struct {
+	Node        Node
+	HashedIndex int
 }
 
-// Remove the given nodeAddr from the ring.
-func (ms *ConsistentHashRing) RemoveNode(nodeAddr string) {
-	// O(N) solution is totally fine here.
-	// O(log N) solution might be overly complicated.
-	nodeIdx := ms.ComputeNodeIndex(nodeAddr)
-	if (len(ms.Nodes) == 1 && ms.Nodes[0].Index == nodeIdx) {
-		ms.Nodes = make([]Node, 0)
-	}
-	nodes := ms.Nodes
-	end := len(ms.Nodes) - 1
-	start := 0
-	idx := 0
-	for {
-		if (start > end) {
-			break
+// List the virtual nodes that were moved by a collision, in ring order
+func (ms *ConsistentHashRing) Collisions() []Collision {
+	collisions := make([]Collision, 0)
+	for _, node := range ms.Nodes {
+		if hashedIndex := ms.ComputeVirtualNodeIndex(node.Addr, node.Token); node.Index != hashedIndex {
+			collisions = append(collisions, Collision{Node: node, HashedIndex: hashedIndex})
 		}
-		middle := (end - start) / 2
-		middle += start
-		if (ms.Nodes[middle].Index == nodeIdx) {
-			idx = middle
-			break
-		} else if (ms.Nodes[middle].Index > nodeIdx) {
-			end = middle - 1
-		} else {
-			start = middle + 1
+	}
+	return collisions
+}
+
+// Map every BlockStore address on the ring to its weight
+func (ms *ConsistentHashRing) members() map[string]int {
+	members := make(map[string]int)
+	for _, node := range ms.Nodes {
+		weight := node.Weight
+		if weight < 1 {
+			weight = 1
 		}
+		members[node.Addr] = weight
 	}
-	ms.Nodes = append(nodes[:idx], nodes[idx+1:]...)
+	return members
 }
 
-// Create consistent hash ring struct with a list of blockstore addresses
-func NewConsistentHashRing(ringSize int, blockStoreAddrs []string) ConsistentHashRing {
-	// You can not use ComputeNodeIndex method to compute the ring index of blockStoreAddr in blockStoreAddrs here.
-	// You will need to use HashMod function, remember to hash the blockStoreAddr before calling HashMod
-	// Hint: refer to ComputeNodeIndex method on how to hash the blockStoreAddr before calling HashMod
-	//panic("todo")
-	var storeNodes []Node
-	for _, nodeAddr := range (blockStoreAddrs) {
-		hashBytes := sha256.Sum256([]byte(nodeAddr))
-		hashString := hex.EncodeToString(hashBytes[:])
-		nodeIdx := HashMod(hashString, ringSize)
-		newNode := Node{Index: nodeIdx, Addr: nodeAddr}
-		storeNodes = append(storeNodes, newNode)
-	}
-	sort.Slice(storeNodes, func(i, j int) bool { 
-		return storeNodes[i].Index < storeNodes[j].Index 
+// Place the virtual nodes of all members on the ring, replacing Nodes.
+// Two virtual nodes may hash to the same index. Such collisions are resolved by
+// linear probing: nodes are placed in order of (hashed index, address, token)
+// and a node whose index is taken moves clockwise to the next free index.
+// The result only depends on the members, not on the order in which they joined.
+// Fails without touching the ring if there are more virtual nodes than ring indices.
+// Finally the placement strategy rebuilds its lookup state for the new members.
+func (ms *ConsistentHashRing) placeNodes(members map[string]int) error {
+	strategy, e := GetPlacementStrategy(ms.Placement)
+	if e != nil {
+		return e
+	}
+	nodes := make([]Node, 0)
+	for addr, weight := range members {
+		for token := 0; token < ms.tokenCount()*weight; token++ {
+			nodes = append(nodes, Node{Addr: addr, Index: ms.ComputeVirtualNodeIndex(addr, token), Token: token, Weight: weight})
+		}
+	}
+	if len(nodes) > ms.RingSize {
+		return fmt.Errorf("%d virtual nodes do not fit on a ring of size %d", len(nodes), ms.RingSize)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Index != nodes[j].Index {
+			return nodes[i].Index < nodes[j].Index
+		}
+		if nodes[i].Addr != nodes[j].Addr {
+			return nodes[i].Addr < nodes[j].Addr
+		}
+		return nodes[i].Token < nodes[j].Token
 	})
-	return ConsistentHashRing{RingSize: ringSize, Nodes: storeNodes}
+	taken := make(map[int]bool, len(nodes))
+	for i := range nodes {
+		for taken[nodes[i].Index] {
+			nodes[i].Index = (nodes[i].Index + 1) % ms.RingSize
+		}
+		taken[nodes[i].Index] = true
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Index < nodes[j].Index
+	})
+	ms.Nodes = nodes
+	strategy.Build(ms)
+	return nil
+}
+
+// Return a deep copy of the ring that can be modified independently
+func (ms *ConsistentHashRing) Copy() ConsistentHashRing {
+	nodes := make([]Node, len(ms.Nodes))
+	copy(nodes, ms.Nodes)
+	lookup := make([]string, len(ms.Lookup))
+	copy(lookup, ms.Lookup)
+	return ConsistentHashRing{
+		RingSize:   ms.RingSize,
+		Nodes:      nodes,
+		Replicas:   ms.Replicas,
+		Tokens:     ms.Tokens,
+		Placement:  ms.Placement,
+		Lookup:     lookup,
+		LoadFactor: ms.LoadFactor,
+		Epoch:      ms.Epoch,
+	}
+}
+
+// Create consistent hash ring struct with a list of blockstore addresses.
+// Addresses that do not fit on the ring or are listed twice are left out.
+func NewConsistentHashRing(ringSize int, blockStoreAddrs []string) ConsistentHashRing {
+	ring, _ := NewVirtualConsistentHashRing(ringSize, 1, blockStoreAddrs)
+	return ring
+}
+
+// Create consistent hash ring struct placing tokens virtual nodes for each blockstore address.
+// Addresses that do not fit on the ring or are listed twice are left out and
+// reported in the error, the returned ring holds all the others.
+func NewVirtualConsistentHashRing(ringSize int, tokens int, blockStoreAddrs []string) (ConsistentHashRing, error) {
+	ring := ConsistentHashRing{RingSize: ringSize, Nodes: make([]Node, 0), Tokens: tokens}
+	skipped := make([]string, 0)
+	for _, nodeAddr := range blockStoreAddrs {
+		if e := ring.AddNode(nodeAddr); e != nil {
+			skipped = append(skipped, e.Error())
+		}
+	}
+	if len(skipped) > 0 {
+		return ring, fmt.Errorf("left out of the ring: %s", strings.Join(skipped, "; "))
+	}
+	return ring, nil
 }
@@ -0,0 +1,169 @@
+package surfstore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testAddrs(n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("localhost:%d", 8081+i)
+	}
+	return addrs
+}
+
+func TestRingCollisionsDoNotDependOnJoinOrder(t *testing.T) {
+	// 12 virtual nodes on 16 indices are bound to collide
+	addrs := testAddrs(6)
+	want, e := NewVirtualConsistentHashRing(16, 2, addrs)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(want.Collisions()) == 0 {
+		t.Fatal("test ring has no collisions")
+	}
+
+	orders := map[string][]string{
+		"reversed": {addrs[5], addrs[4], addrs[3], addrs[2], addrs[1], addrs[0]},
+		"shuffled": {addrs[3], addrs[0], addrs[5], addrs[1], addrs[4], addrs[2]},
+	}
+	for name, order := range orders {
+		ring, e := NewVirtualConsistentHashRing(16, 2, order)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !reflect.DeepEqual(ring.Nodes, want.Nodes) {
+			t.Errorf("%s join order places %v, want %v", name, ring.Nodes, want.Nodes)
+		}
+	}
+
+	// a node that leaves and joins again ends up where it was
+	ring := want.Copy()
+	for _, addr := range addrs {
+		if e := ring.RemoveNode(addr); e != nil {
+			t.Fatal(e)
+		}
+		if e := ring.AddNode(addr); e != nil {
+			t.Fatal(e)
+		}
+		if !reflect.DeepEqual(ring.Nodes, want.Nodes) {
+			t.Fatalf("removing and adding %s places %v, want %v", addr, ring.Nodes, want.Nodes)
+		}
+	}
+}
+
+func TestRingCollisionsProbeClockwise(t *testing.T) {
+	ring, e := NewVirtualConsistentHashRing(16, 2, testAddrs(6))
+	if e != nil {
+		t.Fatal(e)
+	}
+	taken := make(map[int]Node)
+	for _, node := range ring.Nodes {
+		if other, dup := taken[node.Index]; dup {
+			t.Fatalf("%+v and %+v share index %d", node, other, node.Index)
+		}
+		taken[node.Index] = node
+	}
+	for _, collision := range ring.Collisions() {
+		// every index from the hashed one up to the placed one was taken by another node
+		for index := collision.HashedIndex; index != collision.Node.Index; index = (index + 1) % ring.RingSize {
+			if _, ok := taken[index]; !ok {
+				t.Errorf("%s token %d skipped free index %d", collision.Node.Addr, collision.Node.Token, index)
+			}
+		}
+	}
+
+	info := ring.Info()
+	for _, nodeInfo := range info.Nodes {
+		if want := ring.ComputeVirtualNodeIndex(nodeInfo.Node.Addr, nodeInfo.Node.Token); nodeInfo.HashedIndex != want {
+			t.Errorf("%s token %d reported at hashed index %d, want %d", nodeInfo.Node.Addr, nodeInfo.Node.Token, nodeInfo.HashedIndex, want)
+		}
+	}
+}
+
+func TestNewVirtualConsistentHashRingSkipsFailingAddrs(t *testing.T) {
+	tests := []struct {
+		name     string
+		ringSize int
+		addrs    []string
+		want     []string
+	}{
+		{"duplicate", 128, []string{"localhost:8081", "localhost:8081", "localhost:8082"}, []string{"localhost:8081", "localhost:8082"}},
+		{"ring full", 2, []string{"localhost:8081", "localhost:8082", "localhost:8083"}, []string{"localhost:8081", "localhost:8082"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ring, e := NewVirtualConsistentHashRing(test.ringSize, 1, test.addrs)
+			if e == nil {
+				t.Error("no error for the left out address")
+			}
+			if addrs := ring.Addrs(); !reflect.DeepEqual(addrs, test.want) {
+				t.Errorf("ring holds %v, want %v", addrs, test.want)
+			}
+		})
+	}
+}
+
+func TestRingInfoRangesCoverTheRingOnce(t *testing.T) {
+	for _, test := range placementTests {
+		t.Run(test.placement, func(t *testing.T) {
+			ring := placementRing(t, test.placement, testAddrs(3))
+			info := ring.Info()
+			if info.RingSize != ring.RingSize || info.Placement != test.placement || len(info.Nodes) != len(ring.Nodes) {
+				t.Fatalf("info %+v does not describe the ring", info)
+			}
+
+			owner := make([]string, ring.RingSize)
+			owned := 0
+			for i, nodeInfo := range info.Nodes {
+				if i > 0 && nodeInfo.Node.Index < info.Nodes[i-1].Node.Index {
+					t.Fatalf("virtual node %d at index %d follows one at %d", i, nodeInfo.Node.Index, info.Nodes[i-1].Node.Index)
+				}
+				size := 0
+				for _, r := range nodeInfo.Ranges {
+					for ringIndex := r.LowerIndex; ; ringIndex = (ringIndex + 1) % ring.RingSize {
+						if owner[ringIndex] != "" {
+							t.Fatalf("ring index %d is in ranges of %s and %s", ringIndex, owner[ringIndex], nodeInfo.Node.Addr)
+						}
+						owner[ringIndex] = nodeInfo.Node.Addr
+						size++
+						if ringIndex == r.UpperIndex {
+							break
+						}
+					}
+				}
+				if size != nodeInfo.Owned {
+					t.Errorf("%s token %d owns %d indices in its ranges but reports %d", nodeInfo.Node.Addr, nodeInfo.Node.Token, size, nodeInfo.Owned)
+				}
+				owned += size
+			}
+			if owned != ring.RingSize {
+				t.Fatalf("ranges cover %d of %d ring indices", owned, ring.RingSize)
+			}
+			for ringIndex, addr := range owner {
+				if host := ring.FindHostingNode(ringIndex).Addr; addr != host {
+					t.Fatalf("ring index %d is listed under %s but hosted by %s", ringIndex, addr, host)
+				}
+			}
+		})
+	}
+}
+
+func TestGetRingReturnsRingInfo(t *testing.T) {
+	// a single BlockStore owns the whole ring as one range
+	ring := NewConsistentHashRing(128, testAddrs(1))
+	addrs, _ := startMetaStores(t, 1, ring)
+	info := RingInfo{}
+	if e := rpcCall(addrs[0], "MetaStore.GetRing", true, &info); e != nil {
+		t.Fatal(e)
+	}
+	want := []IndexRange{{LowerIndex: 0, UpperIndex: 127}}
+	if len(info.Nodes) != 1 || !reflect.DeepEqual(info.Nodes[0].Ranges, want) || info.Nodes[0].Owned != 128 {
+		t.Fatalf("GetRing returned %+v, want one node owning %v", info, want)
+	}
+	if !reflect.DeepEqual(info, ring.Info()) {
+		t.Errorf("GetRing returned %+v, want %+v", info, ring.Info())
+	}
+}
@@ -0,0 +1,519 @@
+package surfstore
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SWIM-style gossip among BlockStores (Das, Gupta and Motivala, "SWIM: Scalable
+// Weakly-consistent Infection-style Process Group Membership Protocol").
+// Every protocol period a BlockStore pings one ring member; if the member does
+// not answer, a few other members ping it on its behalf, and if none of them
+// gets an answer either the member becomes suspect. A suspect member that does
+// not refute the suspicion by raising its incarnation within SuspectTimeout is
+// dead. Membership updates and the ring epoch are piggybacked on the pings, and
+// a BlockStore that learns of a newer ring pulls it from the peer that has it.
+
+// Number of times a membership update is piggybacked, times log2 of the member count
+const gossipRetransmitMult = 3
+
+// Settings of the gossip protocol
+type GossipConfig struct {
+	// Length of a protocol period
+	Interval time.Duration
+	// Time a member has to answer a ping
+	ProbeTimeout time.Duration
+	// Number of members asked to ping a member that did not answer
+	IndirectProbes int
+	// Time after which a suspect member that did not refute is dead
+	SuspectTimeout time.Duration
+}
+
+// Gossip every interval, suspect a member after a failed round of direct and indirect pings
+// and declare it dead after five more periods
+func DefaultGossipConfig(interval time.Duration) GossipConfig {
+	return GossipConfig{
+		Interval:       interval,
+		ProbeTimeout:   interval / 2,
+		IndirectProbes: 3,
+		SuspectTimeout: 5 * interval,
+	}
+}
+
+// The state of a ring member as known to a BlockStore. Among two records of the
+// same member the one with the higher Incarnation wins, and at equal incarnation
+// dead beats suspect beats alive. Only the member itself raises its incarnation.
+type GossipMember struct {
+	Addr        string
+	State       string
+	Incarnation int
+}
+
+// A ping, carrying the ring epoch of the sender and piggybacked membership updates
+type GossipMessage struct {
+	From    string
+	Epoch   int
+	Updates []GossipMember
+}
+
+// The answer to a ping
+type GossipAck struct {
+	Epoch   int
+	Updates []GossipMember
+}
+
+// Asks a BlockStore to ping Target on behalf of the sender of Message
+type GossipProbe struct {
+	Target  string
+	Message GossipMessage
+}
+
+type gossiper struct {
+	config GossipConfig
+
+	mtx          sync.Mutex
+	members      map[string]*GossipMember
+	suspectSince map[string]time.Time
+	// Remaining number of times the record of a member is piggybacked
+	pending    map[string]int
+	probeOrder []string
+	random     *rand.Rand
+	pulling    bool
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// Start gossiping with the other members of the ring. Gossip begins once the
+// BlockStore has learned its address and a ring from the MetaStore.
+func (bs *BlockStore) StartGossip(config GossipConfig) error {
+	if config.Interval <= 0 || config.ProbeTimeout <= 0 || config.SuspectTimeout <= 0 {
+		return fmt.Errorf("invalid gossip settings %+v", config)
+	}
+	g := &gossiper{
+		config:       config,
+		members:      make(map[string]*GossipMember),
+		suspectSince: make(map[string]time.Time),
+		pending:      make(map[string]int),
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:         make(chan struct{}),
+	}
+	bs.mtx.Lock()
+	bs.gossip = g
+	bs.mtx.Unlock()
+	bs.syncMembers()
+	go bs.runGossip(g)
+	return nil
+}
+
+// Stop gossiping
+func (bs *BlockStore) StopGossip() {
+	if g := bs.gossiper(); g != nil {
+		g.stopOnce.Do(func() { close(g.stop) })
+	}
+}
+
+// Answer a ping: apply its updates and reply with ours
+func (bs *BlockStore) Gossip(msg GossipMessage, ack *GossipAck) error {
+	g := bs.gossiper()
+	if g == nil {
+		return fmt.Errorf("gossip is not enabled on this BlockStore")
+	}
+	self, epoch := bs.gossipIdentity()
+	g.mtx.Lock()
+	for _, update := range msg.Updates {
+		g.applyLocked(update, self)
+	}
+	ack.Updates = g.updatesLocked(self)
+	if sender, ok := g.members[msg.From]; ok && sender.State != NodeAlive {
+		// let a sender we believe suspect or dead refute it
+		ack.Updates = append(ack.Updates, *sender)
+	}
+	g.mtx.Unlock()
+
+	ack.Epoch = epoch
+	if msg.Epoch > epoch {
+		go bs.pullRing(g, msg.From)
+	}
+	return nil
+}
+
+// Ping probe.Target for a peer that could not reach it
+func (bs *BlockStore) GossipProbe(probe GossipProbe, ack *GossipAck) error {
+	g := bs.gossiper()
+	if g == nil {
+		return fmt.Errorf("gossip is not enabled on this BlockStore")
+	}
+	var targetAck GossipAck
+	if e := rpcCallTimeout(probe.Target, "BlockStore.Gossip", probe.Message, &targetAck, g.config.ProbeTimeout); e != nil {
+		return e
+	}
+	*ack = targetAck
+	return nil
+}
+
+// Get the membership as known to this BlockStore
+func (bs *BlockStore) GetMembership(succ bool, members *[]GossipMember) error {
+	g := bs.gossiper()
+	if g == nil {
+		return fmt.Errorf("gossip is not enabled on this BlockStore")
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	list := make([]GossipMember, 0, len(g.members))
+	for _, member := range g.members {
+		list = append(list, *member)
+	}
+	*members = list
+	return nil
+}
+
+func (bs *BlockStore) gossiper() *gossiper {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	return bs.gossip
+}
+
+// Get the own address and the epoch of the known ring, -1 without a ring
+func (bs *BlockStore) gossipIdentity() (string, int) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	if bs.ring == nil {
+		return bs.SelfAddr, -1
+	}
+	return bs.SelfAddr, bs.ring.Epoch
+}
+
+// Make the members the addresses of the known ring. New members start alive.
+func (bs *BlockStore) syncMembers() {
+	bs.mtx.RLock()
+	g := bs.gossip
+	var addrs []string
+	if bs.ring != nil {
+		addrs = bs.ring.Addrs()
+	}
+	bs.mtx.RUnlock()
+	if g == nil {
+		return
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	inRing := make(map[string]bool)
+	for _, addr := range addrs {
+		inRing[addr] = true
+		if _, ok := g.members[addr]; !ok {
+			g.members[addr] = &GossipMember{Addr: addr, State: NodeAlive}
+			g.pending[addr] = g.retransmitsLocked()
+		}
+	}
+	for addr := range g.members {
+		if !inRing[addr] {
+			delete(g.members, addr)
+			delete(g.suspectSince, addr)
+			delete(g.pending, addr)
+		}
+	}
+}
+
+func (bs *BlockStore) runGossip(g *gossiper) {
+	ticker := time.NewTicker(g.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+		}
+		bs.gossipRound(g)
+	}
+}
+
+// One protocol period: expire suspicions, then ping the next member
+func (bs *BlockStore) gossipRound(g *gossiper) {
+	self, epoch := bs.gossipIdentity()
+	g.mtx.Lock()
+	if _, ok := g.members[self]; !ok {
+		// not (or no longer) part of the ring
+		g.mtx.Unlock()
+		return
+	}
+	g.expireSuspectsLocked()
+	target := g.nextTargetLocked(self)
+	msg := GossipMessage{From: self, Epoch: epoch, Updates: g.updatesLocked(self)}
+	g.mtx.Unlock()
+	if target == "" {
+		return
+	}
+
+	var direct, ack GossipAck
+	e := rpcCallTimeout(target, "BlockStore.Gossip", msg, &direct, g.config.ProbeTimeout)
+	if e == nil {
+		ack = direct
+	} else {
+		ack, e = bs.probeIndirectly(g, self, target, msg)
+	}
+	if e != nil {
+		g.mtx.Lock()
+		g.suspectLocked(target)
+		g.mtx.Unlock()
+		return
+	}
+
+	g.mtx.Lock()
+	for _, update := range ack.Updates {
+		g.applyLocked(update, self)
+	}
+	g.mtx.Unlock()
+	if ack.Epoch > epoch {
+		bs.pullRing(g, target)
+	}
+}
+
+// Ask up to IndirectProbes other alive members to ping target, succeeding if any of them reaches it
+func (bs *BlockStore) probeIndirectly(g *gossiper, self string, target string, msg GossipMessage) (GossipAck, error) {
+	g.mtx.Lock()
+	helpers := make([]string, 0)
+	for addr, member := range g.members {
+		if addr != self && addr != target && member.State == NodeAlive {
+			helpers = append(helpers, addr)
+		}
+	}
+	g.random.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	if len(helpers) > g.config.IndirectProbes {
+		helpers = helpers[:g.config.IndirectProbes]
+	}
+	g.mtx.Unlock()
+
+	acks := make(chan GossipAck, len(helpers))
+	var wg sync.WaitGroup
+	for _, helper := range helpers {
+		wg.Add(1)
+		go func(helper string) {
+			defer wg.Done()
+			var ack GossipAck
+			if e := rpcCallTimeout(helper, "BlockStore.GossipProbe", GossipProbe{Target: target, Message: msg}, &ack, 2*g.config.ProbeTimeout); e == nil {
+				acks <- ack
+			}
+		}(helper)
+	}
+	wg.Wait()
+	close(acks)
+	if ack, ok := <-acks; ok {
+		return ack, nil
+	}
+	return GossipAck{}, fmt.Errorf("%s did not answer any ping", target)
+}
+
+// Fetch the ring from a peer that knows a newer one. One pull runs at a time.
+func (bs *BlockStore) pullRing(g *gossiper, addr string) {
+	g.mtx.Lock()
+	if g.pulling {
+		g.mtx.Unlock()
+		return
+	}
+	g.pulling = true
+	g.mtx.Unlock()
+	defer func() {
+		g.mtx.Lock()
+		g.pulling = false
+		g.mtx.Unlock()
+	}()
+
+	var ring ConsistentHashRing
+	if e := rpcCallTimeout(addr, "BlockStore.GetRing", true, &ring, g.config.ProbeTimeout); e != nil {
+		return
+	}
+	_, epoch := bs.gossipIdentity()
+	if ring.Epoch > epoch {
+		log.Printf("Learned ring epoch %d from %s\n", ring.Epoch, addr)
+		succ := false
+		bs.SetRing(RingUpdate{Ring: ring}, &succ)
+	}
+}
+
+// Merge a membership record. Caller holds g.mtx.
+func (g *gossiper) applyLocked(update GossipMember, self string) {
+	local, ok := g.members[update.Addr]
+	if !ok {
+		return
+	}
+	if update.Addr == self {
+		if update.State != NodeAlive && update.Incarnation >= local.Incarnation {
+			// refute the rumor that this BlockStore is suspect or dead
+			local.Incarnation = update.Incarnation + 1
+			local.State = NodeAlive
+			g.pending[self] = g.retransmitsLocked()
+		}
+		return
+	}
+	if !supersedes(update, *local) {
+		return
+	}
+	if update.State != local.State {
+		log.Printf("Gossip: %s is %s (incarnation %d)\n", update.Addr, update.State, update.Incarnation)
+	}
+	*local = update
+	if update.State == NodeSuspect {
+		g.suspectSince[update.Addr] = time.Now()
+	} else {
+		delete(g.suspectSince, update.Addr)
+	}
+	g.pending[update.Addr] = g.retransmitsLocked()
+}
+
+// Mark an alive member suspect. Caller holds g.mtx.
+func (g *gossiper) suspectLocked(addr string) {
+	member, ok := g.members[addr]
+	if !ok || member.State != NodeAlive {
+		return
+	}
+	g.applyLocked(GossipMember{Addr: addr, State: NodeSuspect, Incarnation: member.Incarnation}, "")
+}
+
+// Declare dead the suspects that did not refute in time. Caller holds g.mtx.
+func (g *gossiper) expireSuspectsLocked() {
+	for addr, since := range g.suspectSince {
+		if time.Since(since) < g.config.SuspectTimeout {
+			continue
+		}
+		member := g.members[addr]
+		g.applyLocked(GossipMember{Addr: addr, State: NodeDead, Incarnation: member.Incarnation}, "")
+	}
+}
+
+// Pick the next member to ping, going round-robin through the non-dead members
+// in random order. Caller holds g.mtx.
+func (g *gossiper) nextTargetLocked(self string) string {
+	for attempt := 0; attempt < 2; attempt++ {
+		for len(g.probeOrder) > 0 {
+			addr := g.probeOrder[0]
+			g.probeOrder = g.probeOrder[1:]
+			if member, ok := g.members[addr]; ok && member.State != NodeDead {
+				return addr
+			}
+		}
+		for addr := range g.members {
+			if addr != self {
+				g.probeOrder = append(g.probeOrder, addr)
+			}
+		}
+		g.random.Shuffle(len(g.probeOrder), func(i, j int) {
+			g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+		})
+	}
+	return ""
+}
+
+// Collect the records to piggyback: our own and every record still to be spread. Caller holds g.mtx.
+func (g *gossiper) updatesLocked(self string) []GossipMember {
+	updates := make([]GossipMember, 0)
+	if member, ok := g.members[self]; ok {
+		updates = append(updates, *member)
+	}
+	for addr, left := range g.pending {
+		if left <= 0 {
+			delete(g.pending, addr)
+			continue
+		}
+		g.pending[addr] = left - 1
+		if member, ok := g.members[addr]; ok && addr != self {
+			updates = append(updates, *member)
+		}
+	}
+	return updates
+}
+
+// Caller holds g.mtx
+func (g *gossiper) retransmitsLocked() int {
+	return gossipRetransmitMult * int(math.Ceil(math.Log2(float64(len(g.members)+1))))
+}
+
+// Report whether record a replaces record b of the same member
+func supersedes(a GossipMember, b GossipMember) bool {
+	if a.Incarnation != b.Incarnation {
+		return a.Incarnation > b.Incarnation
+	}
+	return stateRank(a.State) > stateRank(b.State)
+}
+
+func stateRank(state string) int {
+	switch state {
+	case NodeSuspect:
+		return 1
+	case NodeDead:
+		return 2
+	}
+	return 0
+}
+
+// Send ring to every BlockStore in it, in the background. BlockStores that miss
+// it learn the ring through gossip or the ring publisher.
+func (m *MetaStore) publishRing(ring ConsistentHashRing) {
+	for _, addr := range ring.Addrs() {
+		go func(addr string) {
+			succ := false
+			if e := rpcCall(addr, "BlockStore.SetRing", RingUpdate{Ring: ring, SelfAddr: addr}, &succ); e != nil {
+				log.Printf("Could not send ring epoch %d to %s: %v\n", ring.Epoch, addr, e)
+			}
+		}(addr)
+	}
+}
+
+// Send the current ring to one random BlockStore every interval, so that
+// BlockStores started after the MetaStore, or that missed a ring change, learn
+// the ring and their own address. Gossip spreads the ring to the others.
+func (m *MetaStore) StartRingPublisher(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid ring publishing interval %v", interval)
+	}
+	stop := make(chan struct{})
+	m.mtx.Lock()
+	m.publisherStop = stop
+	m.mtx.Unlock()
+	go func() {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if m.Raft != nil {
+				if isLeader, _ := m.Raft.Leader(); !isLeader {
+					continue
+				}
+			}
+			m.mtx.RLock()
+			ring := m.BlockStoreRing.Copy()
+			m.mtx.RUnlock()
+			addrs := ring.Addrs()
+			if len(addrs) == 0 {
+				continue
+			}
+			addr := addrs[random.Intn(len(addrs))]
+			succ := false
+			if e := rpcCallTimeout(addr, "BlockStore.SetRing", RingUpdate{Ring: ring, SelfAddr: addr}, &succ, interval); e != nil {
+				log.Printf("Could not send ring epoch %d to %s: %v\n", ring.Epoch, addr, e)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop the ring publisher
+func (m *MetaStore) StopRingPublisher() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.publisherStop != nil {
+		close(m.publisherStop)
+		m.publisherStop = nil
+	}
+}
@@ -0,0 +1,84 @@
+package surfstore
+
+import (
+	"testing"
+	"time"
+)
+
+// Gossip among the live BlockStores of a ring that also holds an address nothing listens on
+func TestGossipConvergesOnMembershipAndRing(t *testing.T) {
+	liveAddrs, stores := startBlockStores(t, 4, 128)
+	deadAddr := freeAddrs(t, 1)[0]
+	ring := NewConsistentHashRing(128, append(append([]string{}, liveAddrs...), deadAddr))
+	ring.Epoch = 1
+	for i, store := range stores {
+		succ := false
+		if e := store.SetRing(RingUpdate{Ring: ring, SelfAddr: liveAddrs[i]}, &succ); e != nil {
+			t.Fatal(e)
+		}
+		config := DefaultGossipConfig(20 * time.Millisecond)
+		config.SuspectTimeout = 100 * time.Millisecond
+		if e := store.StartGossip(config); e != nil {
+			t.Fatal(e)
+		}
+		t.Cleanup(store.StopGossip)
+	}
+
+	// only one BlockStore hears of the next ring, the others learn it from their peers
+	newRing := ring.Copy()
+	newRing.Epoch = 2
+	succ := false
+	if e := stores[0].SetRing(RingUpdate{Ring: newRing}, &succ); e != nil {
+		t.Fatal(e)
+	}
+
+	waitUntil(t, "gossip converges", func() bool {
+		for _, store := range stores {
+			if _, epoch := store.gossipIdentity(); epoch != newRing.Epoch {
+				return false
+			}
+			members := make([]GossipMember, 0)
+			if e := store.GetMembership(true, &members); e != nil {
+				t.Fatal(e)
+			}
+			for _, member := range members {
+				want := NodeAlive
+				if member.Addr == deadAddr {
+					want = NodeDead
+				}
+				if member.State != want {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+func TestGossipMergesRecordsByIncarnation(t *testing.T) {
+	addrs := testAddrs(2)
+	self, other := addrs[0], addrs[1]
+	g := &gossiper{
+		members:      map[string]*GossipMember{self: {Addr: self, State: NodeAlive}, other: {Addr: other, State: NodeAlive}},
+		suspectSince: make(map[string]time.Time),
+		pending:      make(map[string]int),
+	}
+
+	steps := []struct {
+		name   string
+		update GossipMember
+		want   GossipMember
+	}{
+		{"suspicion beats alive", GossipMember{other, NodeSuspect, 0}, GossipMember{other, NodeSuspect, 0}},
+		{"stale alive is ignored", GossipMember{other, NodeAlive, 0}, GossipMember{other, NodeSuspect, 0}},
+		{"refutation clears suspicion", GossipMember{other, NodeAlive, 1}, GossipMember{other, NodeAlive, 1}},
+		{"death beats suspicion", GossipMember{other, NodeDead, 1}, GossipMember{other, NodeDead, 1}},
+		{"a member refutes rumors about itself", GossipMember{self, NodeDead, 0}, GossipMember{self, NodeAlive, 1}},
+	}
+	for _, step := range steps {
+		g.applyLocked(step.update, self)
+		if got := *g.members[step.want.Addr]; got != step.want {
+			t.Fatalf("%s: record is %+v, want %+v", step.name, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package surfstore
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Health states of a BlockStore as seen by the MetaStore
+const (
+	NodeAlive   = "alive"
+	NodeSuspect = "suspect"
+	NodeDead    = "dead"
+)
+
+// What the MetaStore does about a dead BlockStore
+const (
+	// Only report the state
+	DeadNodeIgnore = "none"
+	// Leave dead BlockStores out of GetBlockStoreMap while another replica is alive
+	DeadNodeRouteAround = "route"
+	// Remove dead BlockStores from the ring, migrating their ranges from the surviving replicas
+	DeadNodeRemove = "remove"
+)
+
+// Settings of the BlockStore health checks
+type HealthConfig struct {
+	// Time between two probes of every BlockStore
+	Interval time.Duration
+	// Time a BlockStore has to answer a probe
+	Timeout time.Duration
+	// Consecutive failed probes after which a BlockStore is suspect
+	SuspectAfter int
+	// Consecutive failed probes after which a BlockStore is dead
+	DeadAfter int
+	// DeadNodeIgnore, DeadNodeRouteAround or DeadNodeRemove
+	Policy string
+}
+
+// Probe every interval, suspect a BlockStore after one missed probe and declare it dead after three
+func DefaultHealthConfig(interval time.Duration, policy string) HealthConfig {
+	return HealthConfig{
+		Interval:     interval,
+		Timeout:      interval,
+		SuspectAfter: 1,
+		DeadAfter:    3,
+		Policy:       policy,
+	}
+}
+
+// Probe results per BlockStore address
+type healthMonitor struct {
+	config HealthConfig
+
+	mtx      sync.Mutex
+	failures map[string]int
+	states   map[string]string
+	// Set while dead BlockStores are being removed from the ring
+	removing bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Start probing the BlockStores of the ring in the background
+func (m *MetaStore) StartHealthChecks(config HealthConfig) error {
+	switch config.Policy {
+	case DeadNodeIgnore, DeadNodeRouteAround, DeadNodeRemove:
+	default:
+		return fmt.Errorf("unknown dead node policy %q", config.Policy)
+	}
+	if config.Interval <= 0 || config.SuspectAfter < 1 || config.DeadAfter < config.SuspectAfter {
+		return fmt.Errorf("invalid health check settings %+v", config)
+	}
+	m.mtx.RLock()
+	replicas := m.BlockStoreRing.Replicas
+	m.mtx.RUnlock()
+	if config.Policy == DeadNodeRemove && replicas < 2 {
+		return fmt.Errorf("dead node policy %q needs at least 2 replicas, the ring keeps %d", config.Policy, replicas)
+	}
+	m.health = &healthMonitor{
+		config:   config,
+		failures: make(map[string]int),
+		states:   make(map[string]string),
+		stop:     make(chan struct{}),
+	}
+	go m.runHealthChecks(m.health)
+	return nil
+}
+
+// Stop probing the BlockStores
+func (m *MetaStore) StopHealthChecks() {
+	if health := m.health; health != nil {
+		health.stopOnce.Do(func() { close(health.stop) })
+	}
+}
+
+// Get the health state of every BlockStore in the ring. Without health checks every
+// BlockStore is alive. While a ring change moves blocks, the BlockStores joining
+// or leaving the ring are listed too, with the state suffixed by "(joining)",
+// "(leaving)" or "(draining)".
+func (m *MetaStore) GetNodeHealth(succ bool, nodeHealth *map[string]string) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.GetNodeHealth", succ, nodeHealth); forwarded {
+		return e
+	}
+	m.mtx.RLock()
+	addrs := m.BlockStoreRing.Addrs()
+	var migration *RingMigration
+	if m.migration != nil {
+		migration = &RingMigration{OldRing: m.migration.OldRing, NewRing: m.migration.NewRing, ReadOnly: m.migration.ReadOnly}
+		addrs = append(addrs, m.migration.NewRing.Addrs()...)
+	}
+	m.mtx.RUnlock()
+	for _, addr := range addrs {
+		state := m.NodeState(addr)
+		if migration != nil {
+			if memberState := migration.MemberState(addr); memberState != NodeMember {
+				state += " (" + memberState + ")"
+			}
+		}
+		(*nodeHealth)[addr] = state
+	}
+	return nil
+}
+
+// Get the health state of a BlockStore
+func (m *MetaStore) NodeState(addr string) string {
+	if m.health == nil {
+		return NodeAlive
+	}
+	m.health.mtx.Lock()
+	defer m.health.mtx.Unlock()
+	if state, ok := m.health.states[addr]; ok {
+		return state
+	}
+	return NodeAlive
+}
+
+// Get the addresses of the dead BlockStores
+func (m *MetaStore) deadNodes() map[string]bool {
+	dead := make(map[string]bool)
+	if m.health == nil {
+		return dead
+	}
+	m.health.mtx.Lock()
+	defer m.health.mtx.Unlock()
+	for addr, state := range m.health.states {
+		if state == NodeDead {
+			dead[addr] = true
+		}
+	}
+	return dead
+}
+
+func (m *MetaStore) runHealthChecks(health *healthMonitor) {
+	ticker := time.NewTicker(health.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-health.stop:
+			return
+		case <-ticker.C:
+		}
+		if m.Raft != nil {
+			// only the leader acts on the BlockStores
+			if isLeader, _ := m.Raft.Leader(); !isLeader {
+				continue
+			}
+		}
+		m.checkHealth(health)
+	}
+}
+
+// Probe every BlockStore once, update their states and apply the policy to the
+// dead ones. Under DeadNodeRemove every dead BlockStore still in the ring is
+// removed in the background, and removals that failed are retried the next round.
+func (m *MetaStore) checkHealth(health *healthMonitor) {
+	m.mtx.RLock()
+	addrs := m.BlockStoreRing.Addrs()
+	m.mtx.RUnlock()
+
+	results := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			results[i] = probeBlockStore(addr, health.config.Timeout)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	health.mtx.Lock()
+	defer health.mtx.Unlock()
+	inRing := make(map[string]bool)
+	for i, addr := range addrs {
+		inRing[addr] = true
+		if results[i] == nil {
+			health.failures[addr] = 0
+		} else {
+			health.failures[addr]++
+		}
+		state := NodeAlive
+		if health.failures[addr] >= health.config.DeadAfter {
+			state = NodeDead
+		} else if health.failures[addr] >= health.config.SuspectAfter {
+			state = NodeSuspect
+		}
+		if old, ok := health.states[addr]; (ok && old != state) || (!ok && state != NodeAlive) {
+			log.Printf("BlockStore %s is %s (%d missed probes)\n", addr, state, health.failures[addr])
+		}
+		health.states[addr] = state
+	}
+	// forget BlockStores that left the ring
+	for addr := range health.states {
+		if !inRing[addr] {
+			delete(health.states, addr)
+			delete(health.failures, addr)
+		}
+	}
+
+	if health.config.Policy != DeadNodeRemove || health.removing {
+		return
+	}
+	dead := make([]string, 0)
+	for _, addr := range addrs {
+		if health.states[addr] == NodeDead {
+			dead = append(dead, addr)
+		}
+	}
+	if len(dead) == 0 {
+		return
+	}
+	// a removal waits for its migration, which must not hold up the probes
+	health.removing = true
+	go func() {
+		for _, addr := range dead {
+			if e := m.removeDeadNode(addr); e != nil {
+				log.Printf("Could not remove dead BlockStore %s, retrying next round: %v\n", addr, e)
+			}
+		}
+		health.mtx.Lock()
+		health.removing = false
+		health.mtx.Unlock()
+	}()
+}
+
+// Remove a dead BlockStore from the ring, copying its ranges from the surviving replicas
+func (m *MetaStore) removeDeadNode(addr string) error {
+	log.Printf("Removing dead BlockStore %s\n", addr)
+	return m.changeRingAvoiding("remove dead "+addr, func(ring *ConsistentHashRing) error {
+		if ring.Replicas < 2 {
+			return fmt.Errorf("the blocks of %s have no other replica", addr)
+		}
+		if e := ring.RemoveNode(addr); e != nil {
+			return e
+		}
+		if len(ring.Nodes) == 0 {
+			return fmt.Errorf("cannot remove the last BlockStore %s", addr)
+		}
+		return nil
+	}, m.deadNodes())
+}
+
+// Drop the dead BlockStores from a BlockStore map unless the policy ignores them.
+// Fails if every BlockStore hosting one of the blocks is dead.
+func (m *MetaStore) routeAround(blockStoreMap map[string][]string) error {
+	if m.health == nil || m.health.config.Policy == DeadNodeIgnore {
+		return nil
+	}
+	dead := m.deadNodes()
+	if len(dead) == 0 {
+		return nil
+	}
+	live := make(map[string]bool)
+	for addr, hashes := range blockStoreMap {
+		if dead[addr] {
+			continue
+		}
+		for _, hash := range hashes {
+			live[hash] = true
+		}
+	}
+	for addr, hashes := range blockStoreMap {
+		if !dead[addr] {
+			continue
+		}
+		for _, hash := range hashes {
+			if !live[hash] {
+				return fmt.Errorf("every BlockStore hosting block %s is down", hash)
+			}
+		}
+		delete(blockStoreMap, addr)
+	}
+	return nil
+}
+
+// Ping a BlockStore, failing if it does not answer within timeout
+func probeBlockStore(addr string, timeout time.Duration) error {
+	succ := false
+	return rpcCallTimeout(addr, "BlockStore.Ping", true, &succ, timeout)
+}
@@ -0,0 +1,116 @@
+package surfstore
+
+import (
+	"testing"
+	"time"
+)
+
+// A MetaStore over a ring of the live BlockStores at liveAddrs and one address
+// nothing listens on, with health checks that only probe when checkHealth is called
+func startHealthTest(t *testing.T, liveAddrs []string, replicas int, policy string) (*MetaStore, string) {
+	t.Helper()
+	deadAddr := freeAddrs(t, 1)[0]
+	ring := NewConsistentHashRing(128, append(append([]string{}, liveAddrs...), deadAddr))
+	ring.Replicas = replicas
+	for _, addr := range liveAddrs {
+		succ := false
+		if e := rpcCall(addr, "BlockStore.SetRing", RingUpdate{Ring: ring, SelfAddr: addr}, &succ); e != nil {
+			t.Fatal(e)
+		}
+	}
+	store := NewMetaStore(ring)
+	config := DefaultHealthConfig(time.Hour, policy)
+	config.Timeout = time.Second
+	if e := store.StartHealthChecks(config); e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(store.StopHealthChecks)
+	return &store, deadAddr
+}
+
+func TestHealthChecksMarkAndRouteAroundDeadBlockStore(t *testing.T) {
+	liveAddrs, _ := startBlockStores(t, 2, 128)
+	store, deadAddr := startHealthTest(t, liveAddrs, 2, DeadNodeRouteAround)
+
+	wantStates := []string{NodeSuspect, NodeSuspect, NodeDead}
+	for round, want := range wantStates {
+		store.checkHealth(store.health)
+		if state := store.NodeState(deadAddr); state != want {
+			t.Fatalf("after %d probes %s is %s, want %s", round+1, deadAddr, state, want)
+		}
+		if state := store.NodeState(liveAddrs[0]); state != NodeAlive {
+			t.Fatalf("after %d probes %s is %s, want %s", round+1, liveAddrs[0], state, NodeAlive)
+		}
+	}
+
+	hashes := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		hashes = append(hashes, GetBlockHashString(testBlock(i).BlockData))
+	}
+	blockStoreMap := make(map[string][]string)
+	if e := store.GetBlockStoreMap(hashes, &blockStoreMap); e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := blockStoreMap[deadAddr]; ok {
+		t.Errorf("dead BlockStore %s is still handed out", deadAddr)
+	}
+	if addrs := store.BlockStoreRing.Addrs(); len(addrs) != 3 {
+		t.Errorf("ring holds %v, want the dead BlockStore kept under the route policy", addrs)
+	}
+
+	// stopping twice is harmless
+	store.StopHealthChecks()
+	store.StopHealthChecks()
+}
+
+func TestStartHealthChecksRefusesRemoveWithoutReplicas(t *testing.T) {
+	store := NewMetaStore(NewConsistentHashRing(128, testAddrs(2)))
+	if e := store.StartHealthChecks(DefaultHealthConfig(time.Hour, DeadNodeRemove)); e == nil {
+		store.StopHealthChecks()
+		t.Fatal("dead BlockStores would be removed along with the only copy of their blocks")
+	}
+	if e := store.StartHealthChecks(DefaultHealthConfig(time.Hour, DeadNodeRouteAround)); e != nil {
+		t.Fatal(e)
+	}
+	store.StopHealthChecks()
+}
+
+func TestHealthChecksRemoveDeadBlockStore(t *testing.T) {
+	liveAddrs, _ := startBlockStores(t, 2, 128)
+	store, deadAddr := startHealthTest(t, liveAddrs, 2, DeadNodeRemove)
+
+	// every block reached its live replicas before the other one died
+	hashes := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		block := testBlock(i)
+		hash := GetBlockHashString(block.BlockData)
+		hashes = append(hashes, hash)
+		for _, host := range store.BlockStoreRing.FindBlockHosts(hash) {
+			if host.Addr == deadAddr {
+				continue
+			}
+			succ := false
+			if e := rpcCall(host.Addr, "BlockStore.PutBlock", block, &succ); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+
+	for round := 0; round < store.health.config.DeadAfter; round++ {
+		store.checkHealth(store.health)
+	}
+	waitUntil(t, "the dead BlockStore leaves the ring", func() bool {
+		store.mtx.RLock()
+		defer store.mtx.RUnlock()
+		return len(store.BlockStoreRing.Addrs()) == 2 && store.migration == nil
+	})
+	for _, addr := range liveAddrs {
+		missing, e := missingBlocks(addr, hashes)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(missing) > 0 {
+			t.Errorf("%s misses %d of %d blocks after the dead BlockStore was removed", addr, len(missing), len(hashes))
+		}
+	}
+}
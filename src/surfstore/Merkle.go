@@ -0,0 +1,163 @@
+package surfstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Number of leaves of a Merkle tree. Each leaf covers an equal share of the ring indices of its range.
+const merkleLeaves = 16
+
+// A Merkle tree over the blocks a BlockStore holds in a range of ring indices.
+// Two BlockStores hold the same blocks in the range exactly when their roots
+// match, and the differing leaves tell which part of the range to compare.
+type MerkleTree struct {
+	Range MerkleRange
+	// Number of blocks in the range
+	Blocks int
+	// Node hashes in heap order: Nodes[0] is the root, the children of node i are
+	// 2i+1 and 2i+2 and the last merkleLeaves nodes are the leaves
+	Nodes []string
+}
+
+// Number of ring indices in r
+func (r MerkleRange) size() int {
+	return mod(r.UpperIndex-r.LowerIndex, r.RingSize) + 1
+}
+
+// Get the leaf of the Merkle tree of r covering blockHash, which must lie in r
+func (r MerkleRange) leaf(blockHash string) int {
+	offset := mod(HashMod(blockHash, r.RingSize)-r.LowerIndex, r.RingSize)
+	return offset * merkleLeaves / r.size()
+}
+
+// Build the Merkle tree of the blocks in r. Every leaf hashes the sorted block
+// hashes it covers and every inner node hashes its two children.
+func buildMerkleTree(r MerkleRange, blockHashes []string) MerkleTree {
+	leaves := make([][]string, merkleLeaves)
+	for _, blockHash := range blockHashes {
+		leaf := r.leaf(blockHash)
+		leaves[leaf] = append(leaves[leaf], blockHash)
+	}
+	tree := MerkleTree{
+		Range:  r,
+		Blocks: len(blockHashes),
+		Nodes:  make([]string, 2*merkleLeaves-1),
+	}
+	for i, leaf := range leaves {
+		sort.Strings(leaf)
+		tree.Nodes[merkleLeaves-1+i] = merkleHash(strings.Join(leaf, ""))
+	}
+	for i := merkleLeaves - 2; i >= 0; i-- {
+		tree.Nodes[i] = merkleHash(tree.Nodes[2*i+1] + tree.Nodes[2*i+2])
+	}
+	return tree
+}
+
+func merkleHash(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+// Get the leaves where two trees of the same range differ, descending only into differing subtrees
+func diffMerkleLeaves(a MerkleTree, b MerkleTree) []int {
+	leaves := make([]int, 0)
+	var descend func(node int)
+	descend = func(node int) {
+		if a.Nodes[node] == b.Nodes[node] {
+			return
+		}
+		if node >= merkleLeaves-1 {
+			leaves = append(leaves, node-(merkleLeaves-1))
+			return
+		}
+		descend(2*node + 1)
+		descend(2*node + 2)
+	}
+	descend(0)
+	return leaves
+}
+
+// Check that r is a range of the ring this BlockStore uses
+func (bs *BlockStore) checkMerkleRange(r MerkleRange) error {
+	if ringSize := bs.ringSize(); r.RingSize != ringSize {
+		return fmt.Errorf("range of a ring of size %d, BlockStore ring size is %d", r.RingSize, ringSize)
+	}
+	return nil
+}
+
+// Build the Merkle tree of each range. The stored blocks are listed once and
+// sorted by ring index, so every range takes a slice of them.
+func (bs *BlockStore) GetMerkleTrees(ranges []MerkleRange, trees *[]MerkleTree) error {
+	for _, r := range ranges {
+		if e := bs.checkMerkleRange(r); e != nil {
+			return e
+		}
+	}
+	ringSize := bs.ringSize()
+	hashes, e := bs.hashesInRange(0, ringSize-1)
+	if e != nil {
+		return e
+	}
+	blocks := make([]indexedBlock, len(hashes))
+	for i, blockHash := range hashes {
+		blocks[i] = indexedBlock{index: HashMod(blockHash, ringSize), hash: blockHash}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].index < blocks[j].index })
+
+	result := make([]MerkleTree, len(ranges))
+	for i, r := range ranges {
+		lower, upper := mod(r.LowerIndex, ringSize), mod(r.UpperIndex, ringSize)
+		var inRange []string
+		if lower <= upper {
+			inRange = blocksBetween(blocks, lower, upper, nil)
+		} else {
+			inRange = blocksBetween(blocks, lower, ringSize-1, nil)
+			inRange = blocksBetween(blocks, 0, upper, inRange)
+		}
+		result[i] = buildMerkleTree(r, inRange)
+	}
+	*trees = result
+	return nil
+}
+
+// A block hash with its ring index
+type indexedBlock struct {
+	index int
+	hash  string
+}
+
+// Append the hashes of the blocks with lower <= index <= upper, blocks sorted by index
+func blocksBetween(blocks []indexedBlock, lower int, upper int, hashes []string) []string {
+	start := sort.Search(len(blocks), func(i int) bool { return blocks[i].index >= lower })
+	for i := start; i < len(blocks) && blocks[i].index <= upper; i++ {
+		hashes = append(hashes, blocks[i].hash)
+	}
+	return hashes
+}
+
+// Get the hashes of the blocks covered by the requested leaves of the Merkle tree of a range
+func (bs *BlockStore) GetMerkleLeafHashes(request MerkleLeafRequest, blockHashes *[]string) error {
+	if e := bs.checkMerkleRange(request.Range); e != nil {
+		return e
+	}
+	hashes, e := bs.hashesInRange(request.Range.LowerIndex, request.Range.UpperIndex)
+	if e != nil {
+		return e
+	}
+	wanted := make(map[int]bool)
+	for _, leaf := range request.Leaves {
+		wanted[leaf] = true
+	}
+	result := make([]string, 0)
+	for _, blockHash := range hashes {
+		if wanted[request.Range.leaf(blockHash)] {
+			result = append(result, blockHash)
+		}
+	}
+	*blockHashes = result
+	return nil
+}
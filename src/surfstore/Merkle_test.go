@@ -0,0 +1,52 @@
+package surfstore
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffMerkleLeavesFindsChangedLeaves(t *testing.T) {
+	r := MerkleRange{LowerIndex: 100, UpperIndex: 27, RingSize: 128}
+	blockHashes := make([]string, 0)
+	for i := 0; len(blockHashes) < 100; i++ {
+		hash := GetBlockHashString(testBlock(i).BlockData)
+		if index := HashMod(hash, r.RingSize); index >= 100 || index <= 27 {
+			blockHashes = append(blockHashes, hash)
+		}
+	}
+	tree := buildMerkleTree(r, blockHashes)
+	if leaves := diffMerkleLeaves(tree, buildMerkleTree(r, blockHashes[1:])); !reflect.DeepEqual(leaves, []int{r.leaf(blockHashes[0])}) {
+		t.Errorf("dropping a block changed leaves %v, want [%d]", leaves, r.leaf(blockHashes[0]))
+	}
+
+	// the order blocks are listed in does not matter
+	reversed := make([]string, len(blockHashes))
+	for i, hash := range blockHashes {
+		reversed[len(blockHashes)-1-i] = hash
+	}
+	if leaves := diffMerkleLeaves(tree, buildMerkleTree(r, reversed)); len(leaves) != 0 {
+		t.Errorf("trees of the same blocks differ in leaves %v", leaves)
+	}
+
+	// every leaf holding a changed block is reported, and only those
+	changed := []string{blockHashes[3], blockHashes[40], blockHashes[77]}
+	want := make(map[int]bool)
+	for _, hash := range changed {
+		want[r.leaf(hash)] = true
+	}
+	wantLeaves := make([]int, 0)
+	for leaf := range want {
+		wantLeaves = append(wantLeaves, leaf)
+	}
+	sort.Ints(wantLeaves)
+	kept := make([]string, 0)
+	for _, hash := range blockHashes {
+		if hash != changed[0] && hash != changed[1] && hash != changed[2] {
+			kept = append(kept, hash)
+		}
+	}
+	if leaves := diffMerkleLeaves(tree, buildMerkleTree(r, kept)); !reflect.DeepEqual(leaves, wantLeaves) {
+		t.Errorf("changed leaves %v, want %v", leaves, wantLeaves)
+	}
+}
@@ -0,0 +1,165 @@
+package surfstore
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MetaCluster runs a group of Raft-replicated MetaStores inside one process,
+// so that tests and experiments can kill and restart individual replicas.
+// Replica i listens on Addrs[i] and keeps its Raft state in Dir/replica<i>.
+type MetaCluster struct {
+	Addrs []string
+	Dir   string
+
+	ring     ConsistentHashRing
+	mtx      sync.Mutex
+	replicas []*metaReplica
+}
+
+// A running replica, nil entries in MetaCluster.replicas are killed replicas
+type metaReplica struct {
+	store    *MetaStore
+	listener *trackingListener
+}
+
+// Start a replica on every address, each starting from ring
+func StartMetaCluster(addrs []string, ring ConsistentHashRing, dir string) (*MetaCluster, error) {
+	c := &MetaCluster{
+		Addrs:    addrs,
+		Dir:      dir,
+		ring:     ring,
+		replicas: make([]*metaReplica, len(addrs)),
+	}
+	for i := range addrs {
+		if e := c.Restart(i); e != nil {
+			c.Shutdown()
+			return nil, e
+		}
+	}
+	return c, nil
+}
+
+// Start replica i again with a fresh MetaStore that recovers from its Raft state.
+// Does nothing if the replica is running.
+func (c *MetaCluster) Restart(i int) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.replicas[i] != nil {
+		return nil
+	}
+
+	store := NewMetaStore(c.ring.Copy())
+	l, e := net.Listen("tcp", c.Addrs[i])
+	if e != nil {
+		return e
+	}
+	if e := store.StartReplication(c.Addrs, i, filepath.Join(c.Dir, fmt.Sprintf("replica%d", i))); e != nil {
+		l.Close()
+		return e
+	}
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("MetaStore", &store)
+	rpcServer.RegisterName("Raft", store.Raft)
+
+	listener := &trackingListener{Listener: l, conns: make(map[net.Conn]bool)}
+	go http.Serve(listener, rpcServer)
+	c.replicas[i] = &metaReplica{store: &store, listener: listener}
+	return nil
+}
+
+// Kill replica i: close its listener and every open connection and stop its Raft node
+func (c *MetaCluster) Kill(i int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	replica := c.replicas[i]
+	if replica == nil {
+		return
+	}
+	replica.listener.CloseAll()
+	replica.store.Raft.Stop()
+	c.replicas[i] = nil
+}
+
+// Get the MetaStore of replica i, nil if it is killed
+func (c *MetaCluster) MetaStore(i int) *MetaStore {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.replicas[i] == nil {
+		return nil
+	}
+	return c.replicas[i].store
+}
+
+// Get the index of a running replica that believes it is the leader, -1 if there is none
+func (c *MetaCluster) Leader() int {
+	for i := range c.Addrs {
+		if store := c.MetaStore(i); store != nil {
+			if isLeader, _ := store.Raft.Leader(); isLeader {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Wait until a leader is elected
+func (c *MetaCluster) WaitForLeader(timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if leader := c.Leader(); leader >= 0 {
+			return leader, nil
+		}
+		time.Sleep(raftTickInterval)
+	}
+	return -1, ErrNoLeader
+}
+
+// Kill every replica
+func (c *MetaCluster) Shutdown() {
+	for i := range c.Addrs {
+		c.Kill(i)
+	}
+}
+
+// A listener that can close the connections it accepted. net/rpc takes over
+// HTTP connections, so closing the listener alone would keep serving them.
+type trackingListener struct {
+	net.Listener
+
+	mtx    sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, e := l.Listener.Accept()
+	if e != nil {
+		return nil, e
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		conn.Close()
+		return nil, fmt.Errorf("listener closed")
+	}
+	l.conns[conn] = true
+	return conn, nil
+}
+
+// Close the listener and every connection it accepted
+func (l *trackingListener) CloseAll() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.closed = true
+	l.Listener.Close()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
@@ -0,0 +1,278 @@
+package surfstore
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const clusterTimeout = 10 * time.Second
+
+// Reserve n free localhost addresses for MetaStore replicas
+func freeAddrs(t *testing.T, n int) []string {
+	t.Helper()
+	addrs := make([]string, n)
+	for i := range addrs {
+		l, e := net.Listen("tcp", "localhost:0")
+		if e != nil {
+			t.Fatal(e)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+	return addrs
+}
+
+func startTestCluster(t *testing.T, replicas int, ring ConsistentHashRing) *MetaCluster {
+	t.Helper()
+	c, e := StartMetaCluster(freeAddrs(t, replicas), ring, t.TempDir())
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(c.Shutdown)
+	return c
+}
+
+func waitForLeader(t *testing.T, c *MetaCluster) int {
+	t.Helper()
+	leader, e := c.WaitForLeader(clusterTimeout)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return leader
+}
+
+// Poll until cond holds
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(clusterTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(raftTickInterval)
+	}
+}
+
+// Version of filename applied on replica i, 0 if it has no such file or is killed
+func fileVersion(c *MetaCluster, i int, filename string) int {
+	store := c.MetaStore(i)
+	if store == nil {
+		return 0
+	}
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+	return store.FileMetaMap[filename].Version
+}
+
+// Members of the BlockStore ring applied on replica i
+func ringAddrs(c *MetaCluster, i int) []string {
+	store := c.MetaStore(i)
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+	return store.BlockStoreRing.Addrs()
+}
+
+// Update a file through replica i, retrying while no leader is known
+func updateFile(t *testing.T, c *MetaCluster, i int, fileMeta FileMetaData) {
+	t.Helper()
+	waitUntil(t, "the update of "+fileMeta.Filename+" is committed", func() bool {
+		latestVersion := 0
+		return rpcCall(c.Addrs[i], "MetaStore.UpdateFile", &fileMeta, &latestVersion) == nil
+	})
+}
+
+// Number of committed UpdateFile commands for filename in the Raft log of replica i
+func committedUpdates(c *MetaCluster, i int, filename string) int {
+	raft := c.MetaStore(i).Raft
+	raft.mtx.Lock()
+	defer raft.mtx.Unlock()
+	updates := 0
+	for _, entry := range raft.log[1 : raft.commitIndex+1] {
+		if entry.Command.Type == LogUpdateFile && entry.Command.FileMeta.Filename == filename {
+			updates++
+		}
+	}
+	return updates
+}
+
+func anotherReplica(c *MetaCluster, i int) int {
+	return (i + 1) % len(c.Addrs)
+}
+
+func TestMetaClusterElectsOneLeader(t *testing.T) {
+	c := startTestCluster(t, 3, NewConsistentHashRing(128, []string{"localhost:8081"}))
+	leader := waitForLeader(t, c)
+
+	// the leader stays the only one once the others heard from it
+	time.Sleep(20 * raftTickInterval)
+	leaders := 0
+	for i := range c.Addrs {
+		isLeader, leaderAddr := c.MetaStore(i).Raft.Leader()
+		if isLeader {
+			leaders++
+		} else if leaderAddr != c.Addrs[leader] {
+			t.Errorf("replica %d follows %q, want %s", i, leaderAddr, c.Addrs[leader])
+		}
+	}
+	if leaders != 1 {
+		t.Fatalf("%d replicas believe they are the leader", leaders)
+	}
+}
+
+func TestMetaClusterElectsNewLeaderWhenLeaderDies(t *testing.T) {
+	c := startTestCluster(t, 3, NewConsistentHashRing(128, []string{"localhost:8081"}))
+	leader := waitForLeader(t, c)
+	updateFile(t, c, leader, FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"h1"}})
+
+	c.Kill(leader)
+	newLeader := waitForLeader(t, c)
+	if newLeader == leader {
+		t.Fatalf("killed replica %d is still the leader", leader)
+	}
+
+	// the committed update survived, and the new leader applies it once it
+	// commits an entry of its own term, then accepts the next one
+	waitUntil(t, "the new leader applied version 1", func() bool {
+		return fileVersion(c, newLeader, "a.txt") == 1
+	})
+	updateFile(t, c, newLeader, FileMetaData{Filename: "a.txt", Version: 2, BlockHashList: []string{"h2"}})
+}
+
+func TestMetaClusterRestartedFollowerCatchesUp(t *testing.T) {
+	c := startTestCluster(t, 3, NewConsistentHashRing(128, []string{"localhost:8081"}))
+	leader := waitForLeader(t, c)
+	follower := anotherReplica(c, leader)
+	updateFile(t, c, leader, FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"h1"}})
+
+	c.Kill(follower)
+	for version := 2; version <= 5; version++ {
+		updateFile(t, c, leader, FileMetaData{Filename: "a.txt", Version: version, BlockHashList: []string{"h"}})
+	}
+	if e := c.Restart(follower); e != nil {
+		t.Fatal(e)
+	}
+	waitUntil(t, "the restarted follower applied version 5", func() bool {
+		return fileVersion(c, follower, "a.txt") == 5
+	})
+}
+
+func TestMetaClusterFollowerForwardsToLeader(t *testing.T) {
+	blockAddrs, _ := startBlockStores(t, 2, 128)
+	c := startTestCluster(t, 3, NewConsistentHashRing(128, blockAddrs[:1]))
+	leader := waitForLeader(t, c)
+	follower := anotherReplica(c, leader)
+
+	updateFile(t, c, follower, FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"h1"}})
+	if version := fileVersion(c, leader, "a.txt"); version != 1 {
+		t.Fatalf("leader has a.txt at version %d, want 1", version)
+	}
+
+	succ := false
+	if e := rpcCall(c.Addrs[follower], "MetaStore.AddNode", NodeInfo{Addr: blockAddrs[1], Weight: 1}, &succ); e != nil {
+		t.Fatal(e)
+	}
+	if status, e := c.MetaStore(leader).WaitForMigration(0); e != nil || status.State != MigrationDone {
+		t.Fatalf("adding %s: %+v %v", blockAddrs[1], status, e)
+	}
+	for i := range c.Addrs {
+		waitUntil(t, "every replica has the added BlockStore", func() bool {
+			return len(ringAddrs(c, i)) == 2
+		})
+	}
+
+	if e := rpcCall(c.Addrs[follower], "MetaStore.RemoveNode", blockAddrs[0], &succ); e != nil {
+		t.Fatal(e)
+	}
+	if status, e := c.MetaStore(leader).WaitForMigration(0); e != nil || status.State != MigrationDone {
+		t.Fatalf("removing %s: %+v %v", blockAddrs[0], status, e)
+	}
+	for i := range c.Addrs {
+		waitUntil(t, "every replica dropped the removed BlockStore", func() bool {
+			addrs := ringAddrs(c, i)
+			return len(addrs) == 1 && addrs[0] == blockAddrs[1]
+		})
+	}
+}
+
+func TestMetaClusterRejectsConflictingUpdateFile(t *testing.T) {
+	c := startTestCluster(t, 3, NewConsistentHashRing(128, []string{"localhost:8081"}))
+	leader := waitForLeader(t, c)
+	updateFile(t, c, leader, FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"first"}})
+
+	// the conflicting update is committed to the log, then rejected when applied
+	conflicting := FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"second"}}
+	latestVersion := 0
+	if e := c.MetaStore(leader).UpdateFile(&conflicting, &latestVersion); e == nil {
+		t.Fatal("conflicting UpdateFile succeeded")
+	}
+	if latestVersion != 1 {
+		t.Fatalf("latest version is %d, want 1", latestVersion)
+	}
+	for i := range c.Addrs {
+		waitUntil(t, "every replica committed both updates", func() bool {
+			return committedUpdates(c, i, "a.txt") == 2
+		})
+		store := c.MetaStore(i)
+		store.mtx.RLock()
+		hashes := store.FileMetaMap["a.txt"].BlockHashList
+		store.mtx.RUnlock()
+		if len(hashes) != 1 || hashes[0] != "first" {
+			t.Errorf("replica %d has a.txt with blocks %v, want [first]", i, hashes)
+		}
+	}
+}
+
+func TestMetaClusterNewLeaderFinishesMigration(t *testing.T) {
+	blockAddrs, _ := startBlockStores(t, 2, 128)
+	ring := NewConsistentHashRing(128, blockAddrs[:1])
+	c := startTestCluster(t, 3, ring)
+	hashes := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		block := testBlock(i)
+		hashes = append(hashes, GetBlockHashString(block.BlockData))
+		succ := false
+		if e := rpcCall(blockAddrs[0], "BlockStore.ReplicateBlock", block, &succ); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	// the leader copies slowly enough to die halfway through
+	leader := waitForLeader(t, c)
+	c.MetaStore(leader).TransferOptions = TransferOptions{BatchBytes: 1, Parallelism: 1, BytesPerSecond: 100}
+	succ := false
+	if e := c.MetaStore(leader).AddNode(NodeInfo{Addr: blockAddrs[1], Weight: 1}, &succ); e != nil {
+		t.Fatal(e)
+	}
+	follower := anotherReplica(c, leader)
+	waitUntil(t, "the start of the migration is committed", func() bool {
+		store := c.MetaStore(follower)
+		store.mtx.RLock()
+		defer store.mtx.RUnlock()
+		return store.migration != nil
+	})
+	c.Kill(leader)
+
+	newLeader := waitForLeader(t, c)
+	for i := range c.Addrs {
+		if i == leader {
+			continue
+		}
+		waitUntil(t, "the new leader finishes the migration", func() bool {
+			store := c.MetaStore(i)
+			store.mtx.RLock()
+			defer store.mtx.RUnlock()
+			return store.migration == nil && len(store.BlockStoreRing.Addrs()) == 2
+		})
+	}
+	store := c.MetaStore(newLeader)
+	store.mtx.RLock()
+	newRing := store.BlockStoreRing.Copy()
+	store.mtx.RUnlock()
+	for _, hash := range hashes {
+		host := newRing.FindBlockHosts(hash)[0].Addr
+		if missing, e := missingBlocks(host, []string{hash}); e != nil || len(missing) > 0 {
+			t.Errorf("block %s is missing from its new host %s (%v)", hash, host, e)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package surfstore
+
+import (
+	"fmt"
+)
+
+// Size and virtual nodes per shard of the ring that assigns filenames to MetaStore shards
+const (
+	shardRingSize   = 4096
+	shardRingTokens = 16
+)
+
+// MetaRouter partitions the file namespace across several MetaStore shards.
+// It is served under the "MetaStore" RPC name, so clients and admins talk to it
+// as if it were a single MetaStore. Every filename belongs to the shard that
+// hosts the hash of the name on ShardRing, which only depends on the set of
+// shards. The first shard is the authority for the BlockStore ring: block
+// lookups and membership changes all go there, the BlockStore rings of the
+// other shards are not used. With bounded-load placement the authority only
+// counts the blocks of its own files toward the loads, as the other shards keep
+// theirs to themselves, so the loads it balances are a sample of the real ones.
+type MetaRouter struct {
+	ShardAddrs []string
+	ShardRing  ConsistentHashRing
+}
+
+// Get the address of the shard holding filename
+func (r *MetaRouter) ShardForFile(filename string) string {
+	return r.ShardRing.FindHostingNode(r.ShardRing.ComputeBlockIndex(GetBlockHashString([]byte(filename)))).Addr
+}
+
+// The shard owning the BlockStore ring
+func (r *MetaRouter) ringAuthority() string {
+	return r.ShardAddrs[0]
+}
+
+// Merge the FileInfoMaps of all shards
+func (r *MetaRouter) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
+	for _, addr := range r.ShardAddrs {
+		shardFileInfoMap := make(map[string]FileMetaData)
+		if e := rpcCall(addr, "MetaStore.GetFileInfoMap", succ, &shardFileInfoMap); e != nil {
+			return fmt.Errorf("MetaStore shard %s: %v", addr, e)
+		}
+		for k, v := range shardFileInfoMap {
+			(*serverFileInfoMap)[k] = v
+		}
+	}
+	return nil
+}
+
+func (r *MetaRouter) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) (err error) {
+	return rpcCall(r.ShardForFile(fileMetaData.Filename), "MetaStore.UpdateFile", fileMetaData, latestVersion)
+}
+
+func (r *MetaRouter) GetBlockStoreMap(blockHashesIn []string, blockStoreMap *map[string][]string) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.GetBlockStoreMap", blockHashesIn, blockStoreMap)
+}
+
+func (r *MetaRouter) GetBlockStoreRoutes(blockHashesIn []string, routes *BlockStoreRoutes) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.GetBlockStoreRoutes", blockHashesIn, routes)
+}
+
+func (r *MetaRouter) AddNode(nodeInfo NodeInfo, succ *bool) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.AddNode", nodeInfo, succ)
+}
+
+func (r *MetaRouter) RemoveNode(nodeAddr string, succ *bool) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.RemoveNode", nodeAddr, succ)
+}
+
+func (r *MetaRouter) DrainNode(nodeAddr string, succ *bool) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.DrainNode", nodeAddr, succ)
+}
+
+func (r *MetaRouter) ReweightNode(nodeInfo NodeInfo, succ *bool) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.ReweightNode", nodeInfo, succ)
+}
+
+func (r *MetaRouter) ResizeRing(ringSize int, succ *bool) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.ResizeRing", ringSize, succ)
+}
+
+func (r *MetaRouter) GetNodeHealth(succ bool, nodeHealth *map[string]string) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.GetNodeHealth", succ, nodeHealth)
+}
+
+func (r *MetaRouter) GetMigrationStatus(id int, status *MigrationStatus) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.GetMigrationStatus", id, status)
+}
+
+func (r *MetaRouter) CancelMigration(id int, succ *bool) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.CancelMigration", id, succ)
+}
+
+func (r *MetaRouter) PlanMembership(change MembershipChange, plan *RebalancePlan) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.PlanMembership", change, plan)
+}
+
+func (r *MetaRouter) ChangeMembership(change MembershipChange, succ *bool) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.ChangeMembership", change, succ)
+}
+
+func (r *MetaRouter) GetRing(succ bool, ringInfo *RingInfo) error {
+	return rpcCall(r.ringAuthority(), "MetaStore.GetRing", succ, ringInfo)
+}
+
+var _ MetaStoreInterface = new(MetaRouter)
+
+// Create a router over the MetaStore shards at shardAddrs, the first of which owns the BlockStore ring.
+// The set of shards must stay the same once files are stored, as it decides
+// where each file lives. Their order only decides which shard is first.
+func NewMetaRouter(shardAddrs []string) (MetaRouter, error) {
+	if len(shardAddrs) == 0 {
+		return MetaRouter{}, fmt.Errorf("no MetaStore shard")
+	}
+	ring, e := NewVirtualConsistentHashRing(shardRingSize, shardRingTokens, shardAddrs)
+	if e != nil {
+		return MetaRouter{}, e
+	}
+	return MetaRouter{
+		ShardAddrs: shardAddrs,
+		ShardRing:  ring,
+	}, nil
+}
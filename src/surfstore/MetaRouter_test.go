@@ -0,0 +1,120 @@
+package surfstore
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+)
+
+// Start n unreplicated MetaStores serving RPCs on free localhost ports
+func startMetaStores(t *testing.T, n int, ring ConsistentHashRing) ([]string, []*MetaStore) {
+	t.Helper()
+	addrs := make([]string, n)
+	stores := make([]*MetaStore, n)
+	for i := 0; i < n; i++ {
+		store := NewMetaStore(ring.Copy())
+		stores[i] = &store
+		server := rpc.NewServer()
+		if e := server.RegisterName("MetaStore", stores[i]); e != nil {
+			t.Fatal(e)
+		}
+		l, e := net.Listen("tcp", "localhost:0")
+		if e != nil {
+			t.Fatal(e)
+		}
+		t.Cleanup(func() { l.Close() })
+		go http.Serve(l, server)
+		addrs[i] = l.Addr().String()
+	}
+	return addrs, stores
+}
+
+func TestMetaRouterShardsDependOnlyOnTheSetOfShards(t *testing.T) {
+	addrs := testAddrs(4)
+	router, e := NewMetaRouter(addrs)
+	if e != nil {
+		t.Fatal(e)
+	}
+	reordered, e := NewMetaRouter([]string{addrs[3], addrs[1], addrs[0], addrs[2]})
+	if e != nil {
+		t.Fatal(e)
+	}
+	files := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		filename := fmt.Sprintf("file%d.txt", i)
+		shard := router.ShardForFile(filename)
+		if other := reordered.ShardForFile(filename); other != shard {
+			t.Fatalf("%s belongs to %s or %s depending on the shard order", filename, shard, other)
+		}
+		files[shard]++
+	}
+	for _, addr := range addrs {
+		if files[addr] < 100 {
+			t.Errorf("shard %s holds %d of 1000 files", addr, files[addr])
+		}
+	}
+
+	if _, e := NewMetaRouter(nil); e == nil {
+		t.Error("router without shards was created")
+	}
+}
+
+func TestMetaRouterRoutesFilesAndBlocks(t *testing.T) {
+	ring := NewConsistentHashRing(128, []string{"localhost:8081"})
+	shardAddrs, shards := startMetaStores(t, 3, ring)
+	router, e := NewMetaRouter(shardAddrs)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for i := 0; i < 30; i++ {
+		filename := fmt.Sprintf("file%d.txt", i)
+		latestVersion := 0
+		if e := router.UpdateFile(&FileMetaData{Filename: filename, Version: 1, BlockHashList: []string{"h"}}, &latestVersion); e != nil {
+			t.Fatal(e)
+		}
+		// a second version 1 is rejected by the shard that holds the file
+		if e := router.UpdateFile(&FileMetaData{Filename: filename, Version: 1}, &latestVersion); e == nil {
+			t.Fatalf("%s accepted version 1 twice", filename)
+		}
+	}
+	for i, shard := range shards {
+		shard.mtx.RLock()
+		for filename := range shard.FileMetaMap {
+			if owner := router.ShardForFile(filename); owner != shardAddrs[i] {
+				t.Errorf("%s is stored on %s, want %s", filename, shardAddrs[i], owner)
+			}
+		}
+		shard.mtx.RUnlock()
+	}
+
+	files := make(map[string]FileMetaData)
+	succ := false
+	if e := router.GetFileInfoMap(&succ, &files); e != nil {
+		t.Fatal(e)
+	}
+	if len(files) != 30 {
+		t.Fatalf("router lists %d files, want 30", len(files))
+	}
+
+	// the BlockStore ring of the first shard answers block lookups and admin calls
+	shards[0].mtx.Lock()
+	shards[0].BlockStoreRing = NewConsistentHashRing(128, []string{"localhost:9090"})
+	shards[0].mtx.Unlock()
+	blockStoreMap := make(map[string][]string)
+	if e := router.GetBlockStoreMap([]string{GetBlockHashString([]byte("x"))}, &blockStoreMap); e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := blockStoreMap["localhost:9090"]; !ok || len(blockStoreMap) != 1 {
+		t.Errorf("block routed to %v, want localhost:9090 from the first shard", blockStoreMap)
+	}
+	ringInfo := RingInfo{}
+	if e := router.GetRing(true, &ringInfo); e != nil {
+		t.Fatal(e)
+	}
+	if len(ringInfo.Nodes) != 1 || ringInfo.Nodes[0].Node.Addr != "localhost:9090" {
+		t.Errorf("router returned the ring %+v, want the one of the first shard", ringInfo)
+	}
+}
@@ -2,17 +2,65 @@ package surfstore
 
 import (
 	"fmt"
+	"log"
 	"net/rpc"
-	"crypto/sha256"
-	"encoding/hex"
+	"sync"
+	"time"
 )
 
+// MetaStore RPCs are served concurrently. mtx guards FileMetaMap, BlockStoreRing
+// and Log and is never held across an RPC to a BlockStore. Membership changes
+// are additionally serialized by membershipMtx for their whole duration,
+// including the block migration.
 type MetaStore struct {
 	FileMetaMap    map[string]FileMetaData
 	BlockStoreRing ConsistentHashRing
+	// Write-ahead log and snapshots, nil when the MetaStore only keeps its state in memory
+	Log *MetaStoreLog
+	// Raft replica, nil unless the MetaStore is replicated (see StartReplication)
+	Raft *RaftNode
+	// Batching, parallelism and throttling of the block copies made by migrations and repairs
+	TransferOptions TransferOptions
+	// BlockStore health checks, nil unless started (see StartHealthChecks)
+	health *healthMonitor
+	// Closed to stop the ring publisher (see StartRingPublisher), guarded by mtx
+	publisherStop chan struct{}
+	// Closed to stop anti-entropy (see StartAntiEntropy), guarded by mtx
+	antiEntropyStop chan struct{}
+
+	mtx           sync.RWMutex
+	membershipMtx sync.Mutex
+
+	// Bounded-load bookkeeping, guarded by mtx. spills maps the blocks placed off
+	// their natural hosts in BlockStoreRing to their hosts. placedBlocks are the
+	// other blocks handed out since the last ring change that no file references
+	// yet, so they keep their hosts. Both are cleared by every ring change.
+	// Rebuilt on demand when nil: the blocks referenced by the files and the
+	// number of them per BlockStore, which capacities are computed from.
+	spills       map[string][]string
+	placedBlocks map[string]bool
+	knownBlocks  map[string]bool
+	blockLoads   map[string]int
+	// Ring change whose blocks are being moved, guarded by mtx, nil if there is none
+	migration *RingMigration
+	// Set once the BlockStores were sent the pending ring of migration, guarded
+	// by mtx. Only then does GetBlockStoreMap list the new hosts.
+	migrationAnnounced bool
+	// Highest ring epoch handed out so far, including to aborted migrations,
+	// guarded by mtx. New rings take the next one so no epoch is used twice.
+	maxEpoch int
+
+	// Migration jobs started by this MetaStore, job i has id i+1, guarded by jobMtx
+	jobMtx sync.Mutex
+	jobs   []*migrationJob
 }
 
 func (m *MetaStore) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.GetFileInfoMap", succ, serverFileInfoMap); forwarded {
+		return e
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
 	for k, v := range m.FileMetaMap {
 		(*serverFileInfoMap)[k] = v
 	}
@@ -21,6 +69,20 @@ func (m *MetaStore) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]Fil
 }
 
 func (m *MetaStore) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) (err error) {
+	if forwarded, e := m.forwardToLeader("MetaStore.UpdateFile", fileMetaData, latestVersion); forwarded {
+		return e
+	}
+	if m.Raft != nil {
+		err = m.Raft.Submit(MetaLogEntry{Type: LogUpdateFile, FileMeta: *fileMetaData})
+		m.mtx.RLock()
+		*latestVersion = m.FileMetaMap[fileMetaData.Filename].Version
+		m.mtx.RUnlock()
+		return
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	oldFileMeta, exist := m.FileMetaMap[fileMetaData.Filename]
 	if !exist {
 		// Create a dummy old file meta if the file does not exist yet
@@ -33,7 +95,13 @@ func (m *MetaStore) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) (
 
 	// Compare the Version and decide to update or not. Should be exactly 1 greater
 	if oldFileMeta.Version+1 == fileMetaData.Version {
+		err = m.logEntry(MetaLogEntry{Type: LogUpdateFile, FileMeta: *fileMetaData})
+		if err != nil {
+			return
+		}
 		m.FileMetaMap[fileMetaData.Filename] = *fileMetaData
+		m.countFileBlocksLocked(fileMetaData.BlockHashList)
+		m.maybeSnapshot()
 	} else {
 		err = fmt.Errorf("Unexpected file Version. Yours:%d, Expected:%d, Lastest on Server:%d\n",
 			fileMetaData.Version, oldFileMeta.Version+1, oldFileMeta.Version)
@@ -45,133 +113,585 @@ func (m *MetaStore) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) (
 }
 
 // Given an input hashlist, returns a mapping of BlockStore addresses to hashlists.
+// With replication every block hash is listed under each BlockStore of its replica set.
 func (m *MetaStore) GetBlockStoreMap(blockHashesIn []string, blockStoreMap *map[string][]string) error {
 	// this should be different from your project 3 implementation. Now we have multiple
 	// Blockstore servers instead of one Blockstore server in project 3. For each blockHash in
 	// blockHashesIn, you want to find the BlockStore server it is in using consistent hash ring.
-	//panic("todo")
+	if forwarded, e := m.forwardToLeader("MetaStore.GetBlockStoreMap", blockHashesIn, blockStoreMap); forwarded {
+		return e
+	}
+	m.mtx.RLock()
+	bounded := m.BlockStoreRing.LoadFactor > 0
+	m.mtx.RUnlock()
+	if bounded {
+		if e := m.placeBlocks(blockHashesIn, blockStoreMap); e != nil {
+			return e
+		}
+		m.mtx.RLock()
+		m.addMigrationHostsLocked(blockHashesIn, *blockStoreMap)
+		m.mtx.RUnlock()
+		return m.routeAround(*blockStoreMap)
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
 	ring := m.BlockStoreRing
+	if len(ring.Nodes) == 0 {
+		return fmt.Errorf("no BlockStore in the ring")
+	}
 	storeMap := make(map[string][]string)
-	for _, hash := range (blockHashesIn) {
-		hashIdx := HashMod(hash, ring.RingSize)
-		node := ring.FindHostingNode(hashIdx)
-		addrSlice, ok := storeMap[node.Addr]
-		if (!ok) {
-			storeMap[node.Addr] = []string{hash}
-		} else {
-			addrSlice = append(addrSlice, hash)
-			storeMap[node.Addr] = addrSlice
+	for _, hash := range blockHashesIn {
+		for _, node := range ring.FindBlockHosts(hash) {
+			storeMap[node.Addr] = append(storeMap[node.Addr], hash)
 		}
 	}
+	m.addMigrationHostsLocked(blockHashesIn, storeMap)
 	*blockStoreMap = storeMap
+	return m.routeAround(storeMap)
+}
+
+// Get the BlockStore ring: its size, epoch and settings and every virtual node in
+// ring order with the ranges of ring indices it hosts
+func (m *MetaStore) GetRing(succ bool, ringInfo *RingInfo) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.GetRing", succ, ringInfo); forwarded {
+		return e
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	*ringInfo = m.BlockStoreRing.Info()
 	return nil
 }
 
-// Add the specified BlockStore node to the cluster and migrate the blocks
-func (m *MetaStore) AddNode(nodeAddr string, succ *bool) error {
-	// compute node index
-	//panic("todo")
-	if (len(m.BlockStoreRing.Nodes) == 0) {
-		m.BlockStoreRing.AddNode(nodeAddr)
-		return nil
+// Like GetBlockStoreMap, and also return the epoch of the ring the map was computed
+// from. A client caching the map can drop it once a BlockStore reports a
+// WrongOwnerError with a newer epoch.
+func (m *MetaStore) GetBlockStoreRoutes(blockHashesIn []string, routes *BlockStoreRoutes) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.GetBlockStoreRoutes", blockHashesIn, routes); forwarded {
+		return e
 	}
-	hashBytes := sha256.Sum256([]byte(nodeAddr))
-	hashString := hex.EncodeToString(hashBytes[:])
-	nodeIdx := HashMod(hashString, m.BlockStoreRing.RingSize)
-	// find successor node
-	//panic("todo")
-	succNode := m.BlockStoreRing.FindHostingNode(nodeIdx)
-	// add the node into the ring
-	m.BlockStoreRing.AddNode(nodeAddr)
-	// call RPC to migrate some blocks from successor node to this node
-	nodeSlice := m.BlockStoreRing.Nodes
-	low := 0
-	if (nodeIdx == nodeSlice[0].Index) {
-		low = len(nodeSlice)-1
-	} else {
-		for i, node := range(nodeSlice) {
-			if (node.Index == nodeIdx) {
-				if (i > 0) {
-					low = i - 1
+	// read the epoch first, a ring changed meanwhile only makes it look older
+	m.mtx.RLock()
+	epoch := m.BlockStoreRing.Epoch
+	m.mtx.RUnlock()
+	blockStoreMap := make(map[string][]string)
+	if e := m.GetBlockStoreMap(blockHashesIn, &blockStoreMap); e != nil {
+		return e
+	}
+	*routes = BlockStoreRoutes{Epoch: epoch, BlockStoreMap: blockStoreMap}
+	return nil
+}
+
+// GetBlockStoreMap in bounded-load mode. Blocks placed before are found where
+// they were placed. New blocks are placed on the first hosts below their
+// capacity, counting the blocks of the files and those placed by this call,
+// and spills are logged before they are handed out. While a ring change runs,
+// new blocks go to their natural hosts, so the spills it moves stay the same.
+func (m *MetaStore) placeBlocks(blockHashesIn []string, blockStoreMap *map[string][]string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ring := &m.BlockStoreRing
+	if len(ring.Nodes) == 0 {
+		return fmt.Errorf("no BlockStore in the ring")
+	}
+	m.trackBlocks()
+
+	loads := make(map[string]int, len(m.blockLoads))
+	for addr, load := range m.blockLoads {
+		loads[addr] = load
+	}
+	storeMap := make(map[string][]string)
+	for _, hash := range blockHashesIn {
+		hosts := findPlacedHosts(ring, m.spills, hash)
+		if _, spilled := m.spills[hash]; !spilled && !m.knownBlocks[hash] && !m.placedBlocks[hash] && m.migration == nil {
+			hosts, spilled = ring.PlaceBlock(hash, loads)
+			if spilled {
+				addrs := nodeAddrs(hosts)
+				if e := m.logEntry(MetaLogEntry{Type: LogSpill, BlockHash: hash, Hosts: addrs}); e != nil {
+					return e
+				}
+				if m.spills == nil {
+					m.spills = make(map[string][]string)
 				}
-				break
+				m.spills[hash] = addrs
+				log.Printf("Block %s spilled to %v\n", hash, addrs)
+			} else {
+				if m.placedBlocks == nil {
+					m.placedBlocks = make(map[string]bool)
+				}
+				m.placedBlocks[hash] = true
+			}
+			for _, node := range hosts {
+				loads[node.Addr]++
 			}
 		}
+		for _, node := range hosts {
+			storeMap[node.Addr] = append(storeMap[node.Addr], hash)
+		}
 	}
-	low = nodeSlice[low].Index + 1
-	if (low == m.BlockStoreRing.RingSize) {
-		low = 0
+	m.maybeSnapshot()
+	*blockStoreMap = storeMap
+	return nil
+}
+
+// Rebuild the bounded-load bookkeeping from the files if it is missing. Caller must hold m.mtx.
+func (m *MetaStore) trackBlocks() {
+	if m.knownBlocks == nil {
+		m.knownBlocks = make(map[string]bool)
+		for _, fileMeta := range m.FileMetaMap {
+			for _, hash := range fileMeta.BlockHashList {
+				m.knownBlocks[hash] = true
+			}
+		}
+		m.blockLoads = nil
 	}
-	inst := MigrationInstruction{
-		LowerIndex: low,
-		UpperIndex: nodeIdx,
-		DestAddr: nodeAddr,
+	if m.blockLoads == nil {
+		m.blockLoads = m.BlockStoreRing.CountLoads(m.knownBlocks, m.spills)
 	}
+}
 
-	// connect to the server
-	conn, e := rpc.DialHTTP("tcp", succNode.Addr)
+// Count the blocks of a file update toward the loads of their hosts. Caller must hold m.mtx.
+func (m *MetaStore) countFileBlocksLocked(blockHashes []string) {
+	if m.knownBlocks == nil {
+		return
+	}
+	for _, hash := range blockHashes {
+		if m.knownBlocks[hash] {
+			continue
+		}
+		m.knownBlocks[hash] = true
+		delete(m.placedBlocks, hash)
+		if m.blockLoads != nil {
+			for _, node := range findPlacedHosts(&m.BlockStoreRing, m.spills, hash) {
+				m.blockLoads[node.Addr]++
+			}
+		}
+	}
+}
+
+// Forget the bounded-load placements made in the ring a ring change replaced.
+// Spilled blocks are moved to their natural hosts by the change. Caller must hold m.mtx.
+func (m *MetaStore) resetPlacementsLocked() {
+	m.spills = nil
+	m.placedBlocks = nil
+	m.blockLoads = nil
+}
+
+// Add the specified BlockStore node to the cluster. The blocks migrate in the background, see GetMigrationStatus.
+func (m *MetaStore) AddNode(nodeInfo NodeInfo, succ *bool) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.AddNode", nodeInfo, succ); forwarded {
+		return e
+	}
+	if nodeInfo.Weight < 0 {
+		return fmt.Errorf("invalid weight %d for %s", nodeInfo.Weight, nodeInfo.Addr)
+	}
+	_, e := m.startRingChange("add "+nodeInfo.Addr, func(ring *ConsistentHashRing) error {
+		return ring.AddWeightedNode(nodeInfo.Addr, nodeInfo.Weight)
+	}, m.deadNodes(), nil)
 	if e != nil {
 		return e
 	}
+	*succ = true
+	return nil
+}
 
-	// perform the call
-	e = conn.Call("BlockStore.MigrateBlocks", inst, succ)
+// Remove the specified BlockStore node from the cluster. The blocks migrate in the background, see GetMigrationStatus.
+func (m *MetaStore) RemoveNode(nodeAddr string, succ *bool) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.RemoveNode", nodeAddr, succ); forwarded {
+		return e
+	}
+	_, e := m.startRingChange("remove "+nodeAddr, removeFromRing(nodeAddr), m.deadNodes(), nil)
 	if e != nil {
-		conn.Close()
 		return e
 	}
+	*succ = true
+	return nil
+}
 
-	// deal with added node in BlockStoreRing
-	//panic("todo")
+// Drain the specified BlockStore node and then remove it from the cluster. The
+// node is made read-only, so clients write to the new hosts of its ranges
+// meanwhile, and its ranges are copied from it to their new hosts and verified
+// before the ring without it is committed. Canceling the job makes the node
+// writable again and leaves it in the ring. The node must be reachable.
+func (m *MetaStore) DrainNode(nodeAddr string, succ *bool) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.DrainNode", nodeAddr, succ); forwarded {
+		return e
+	}
+	alive := false
+	if e := rpcCall(nodeAddr, "BlockStore.Ping", true, &alive); e != nil {
+		return fmt.Errorf("cannot drain unreachable BlockStore %s: %v", nodeAddr, e)
+	}
+	_, e := m.startRingChange("drain "+nodeAddr, removeFromRing(nodeAddr), m.deadNodes(), []string{nodeAddr})
+	if e != nil {
+		return e
+	}
 	*succ = true
-	// close the connection
-	return conn.Close()
+	return nil
 }
 
-// Remove the specified BlockStore node from the cluster and migrate the blocks
-func (m *MetaStore) RemoveNode(nodeAddr string, succ *bool) error {
-	if (len(m.BlockStoreRing.Nodes) == 0) {
+// A ring change removing nodeAddr, unless it is the last BlockStore
+func removeFromRing(nodeAddr string) func(ring *ConsistentHashRing) error {
+	return func(ring *ConsistentHashRing) error {
+		if e := ring.RemoveNode(nodeAddr); e != nil {
+			return e
+		}
+		if len(ring.Nodes) == 0 {
+			return fmt.Errorf("cannot remove the last BlockStore %s, its blocks would have nowhere to go", nodeAddr)
+		}
 		return nil
 	}
-	// compute node index
-	hashBytes := sha256.Sum256([]byte(nodeAddr))
-	hashString := hex.EncodeToString(hashBytes[:])
-	nodeIdx := HashMod(hashString, m.BlockStoreRing.RingSize)
-	m.BlockStoreRing.RemoveNode(nodeAddr)
-	// find successor node
-	succNode := m.BlockStoreRing.FindHostingNode(nodeIdx)
-	// find lower bound
-	// call RPC to migrate all blocks from this node to successor node
-	inst := MigrationInstruction{
-		LowerIndex: 0,
-		UpperIndex: m.BlockStoreRing.RingSize - 1,
-		DestAddr: succNode.Addr,
+}
+
+// Change the weight of the specified BlockStore node. The blocks of the ranges it
+// gains or loses migrate in the background, see GetMigrationStatus.
+func (m *MetaStore) ReweightNode(nodeInfo NodeInfo, succ *bool) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.ReweightNode", nodeInfo, succ); forwarded {
+		return e
+	}
+	if nodeInfo.Weight < 1 {
+		return fmt.Errorf("invalid weight %d for %s", nodeInfo.Weight, nodeInfo.Addr)
 	}
+	_, e := m.startRingChange(fmt.Sprintf("reweight %s to %d", nodeInfo.Addr, nodeInfo.Weight), func(ring *ConsistentHashRing) error {
+		return ring.ReweightNode(nodeInfo.Addr, nodeInfo.Weight)
+	}, m.deadNodes(), nil)
+	if e != nil {
+		return e
+	}
+	*succ = true
+	return nil
+}
 
+// Change the ring size of the running cluster. Every block gets a new ring
+// index, so the blocks are listed on the BlockStores and copied to their hosts in
+// the resized ring, which is sent as pending meanwhile. As with a membership
+// change, the resize is logged, checked before the resized ring is committed,
+// resumed after a crash and can be canceled while copying (see runMigration).
+// The blocks move in the background, see GetMigrationStatus.
+func (m *MetaStore) ResizeRing(ringSize int, succ *bool) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.ResizeRing", ringSize, succ); forwarded {
+		return e
+	}
+	_, e := m.startRingChange(fmt.Sprintf("resize to %d", ringSize), func(ring *ConsistentHashRing) error {
+		if ring.RingSize == ringSize {
+			return fmt.Errorf("the ring size is %d already", ringSize)
+		}
+		return ring.Resize(ringSize)
+	}, m.deadNodes(), nil)
+	if e != nil {
+		return e
+	}
+	*succ = true
+	return nil
+}
+
+// Apply change to a copy of the ring and migrate the blocks from their owners in
+// the old ring to their owners in the new one, leaving the BlockStores in down
+// out of the migration. Unlike the admin calls, waits for the migration to finish.
+func (m *MetaStore) changeRingAvoiding(description string, change func(ring *ConsistentHashRing) error, down map[string]bool) error {
+	job, e := m.startRingChange(description, change, down, nil)
+	if e != nil {
+		return e
+	}
+	<-job.done
+	if status := job.snapshot(); status.State != MigrationDone {
+		return fmt.Errorf("migration %d %s: %s", status.Id, status.State, status.Error)
+	}
+	return nil
+}
+
+// Compute the ring after change and log the start of its migration, which keeps
+// the BlockStores in readOnly read-only, after finishing any migration left by a
+// crash. Caller must hold membershipMtx.
+func (m *MetaStore) logRingChange(change func(ring *ConsistentHashRing) error, down map[string]bool, readOnly []string) (RingMigration, error) {
+	if e := m.catchUp(); e != nil {
+		return RingMigration{}, e
+	}
+	if e := m.resumeMigration(down); e != nil {
+		return RingMigration{}, e
+	}
+
+	m.mtx.RLock()
+	oldRing := m.BlockStoreRing.Copy()
+	// spilled blocks go back to their natural hosts in the new ring
+	spills := copySpills(m.spills)
+	m.mtx.RUnlock()
+	newRing := oldRing.Copy()
+	if e := change(&newRing); e != nil {
+		return RingMigration{}, e
+	}
+	newRing.Epoch = m.nextEpoch()
+
+	migration := RingMigration{OldRing: oldRing, NewRing: newRing, Spills: spills, ReadOnly: readOnly}
+	if e := m.recordMigration(MetaLogEntry{Type: LogMigrationStart, Migration: migration}); e != nil {
+		return RingMigration{}, e
+	}
+	return migration, nil
+}
+
+// Connect to the server at addr, perform a single call and close the connection
+func rpcCall(addr string, serviceMethod string, args interface{}, reply interface{}) error {
 	// connect to the server
-	conn, e := rpc.DialHTTP("tcp", nodeAddr)
+	conn, e := rpc.DialHTTP("tcp", addr)
 	if e != nil {
 		return e
 	}
 
 	// perform the call
-	e = conn.Call("BlockStore.MigrateBlocks", inst, succ)
+	e = conn.Call(serviceMethod, args, reply)
 	if e != nil {
 		conn.Close()
 		return e
 	}
 
-	// deal with removed node in BlockStoreRing
-
 	// close the connection
 	return conn.Close()
 }
 
+// rpcCall, failing if the call does not complete within timeout. reply must
+// not be used after a timeout, as the call may still write to it.
+func rpcCallTimeout(addr string, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- rpcCall(addr, serviceMethod, args, reply)
+	}()
+	select {
+	case e := <-result:
+		return e
+	case <-time.After(timeout):
+		return fmt.Errorf("%s on %s did not complete within %v", serviceMethod, addr, timeout)
+	}
+}
+
+// Durably record a state change before it is applied. A MetaStore without a log
+// keeps its state in memory only and records nothing.
+func (m *MetaStore) logEntry(entry MetaLogEntry) error {
+	if m.Log == nil {
+		return nil
+	}
+	return m.Log.Append(&entry)
+}
+
+// Log the new ring and make it the current BlockStoreRing. Caller must hold m.mtx.
+func (m *MetaStore) commitRing(ring ConsistentHashRing) error {
+	if e := m.logEntry(MetaLogEntry{Type: LogRing, Ring: ring}); e != nil {
+		return e
+	}
+	m.BlockStoreRing = ring
+	m.noteEpochLocked(ring.Epoch)
+	m.resetPlacementsLocked()
+	m.maybeSnapshot()
+	return nil
+}
+
+// Get the epoch for the next ring, above every epoch handed out so far
+func (m *MetaStore) nextEpoch() int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	if m.BlockStoreRing.Epoch > m.maxEpoch {
+		return m.BlockStoreRing.Epoch + 1
+	}
+	return m.maxEpoch + 1
+}
+
+// Remember that epoch was handed out. Caller must hold m.mtx.
+func (m *MetaStore) noteEpochLocked(epoch int) {
+	if epoch > m.maxEpoch {
+		m.maxEpoch = epoch
+	}
+}
+
+// Make ring the current BlockStoreRing, through Raft in a replicated MetaStore
+func (m *MetaStore) setRing(ring ConsistentHashRing) error {
+	if m.Raft != nil {
+		return m.Raft.Submit(MetaLogEntry{Type: LogRing, Ring: ring})
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.commitRing(ring)
+}
+
+// Snapshot the state and compact the log once enough entries have accumulated.
+// Every change is already durable in the log, so a failed snapshot is only reported.
+func (m *MetaStore) maybeSnapshot() {
+	if m.Log == nil || !m.Log.NeedsSnapshot() {
+		return
+	}
+	if e := m.Log.Snapshot(m.FileMetaMap, m.BlockStoreRing, m.spills, m.migration, m.maxEpoch); e != nil {
+		log.Println("MetaStore snapshot failed:", e)
+	}
+}
+
+// Apply recovered log entries, in order, on top of the given state. Also
+// returns the highest ring epoch handed out, which aborted migrations count toward.
+func replayMetaLog(entries []MetaLogEntry, fileMetaMap map[string]FileMetaData, ring ConsistentHashRing,
+	spills map[string][]string, migration *RingMigration, maxEpoch int) (ConsistentHashRing, *RingMigration, int) {
+	for _, entry := range entries {
+		switch entry.Type {
+		case LogUpdateFile:
+			fileMetaMap[entry.FileMeta.Filename] = entry.FileMeta
+		case LogRing:
+			ring = entry.Ring
+			clearSpills(spills)
+		case LogSpill:
+			spills[entry.BlockHash] = entry.Hosts
+		case LogMigrationStart:
+			started := entry.Migration
+			migration = &started
+			if started.NewRing.Epoch > maxEpoch {
+				maxEpoch = started.NewRing.Epoch
+			}
+		case LogMigrationCommit:
+			ring = entry.Ring
+			clearSpills(spills)
+			if migration != nil {
+				migration.Committed = true
+			}
+		case LogMigrationDone, LogMigrationAbort:
+			migration = nil
+		}
+	}
+	if ring.Epoch > maxEpoch {
+		maxEpoch = ring.Epoch
+	}
+	return ring, migration, maxEpoch
+}
+
+// Replicate this MetaStore through Raft across the MetaStores at peers, this one
+// being peers[id]. Every replica must start with the same BlockStoreRing. The
+// Raft state is persisted in raftDir, or only kept in memory if raftDir is "".
+// The caller registers m.Raft as the "Raft" RPC service next to the MetaStore.
+// Client and admin calls made to a follower are forwarded to the leader. A
+// replica that becomes the leader resumes the pending migration, if any.
+func (m *MetaStore) StartReplication(peers []string, id int, raftDir string) error {
+	if m.Log != nil {
+		return fmt.Errorf("a replicated MetaStore keeps its log in Raft, not in a MetaStoreLog")
+	}
+	if m.BlockStoreRing.LoadFactor > 0 {
+		return fmt.Errorf("bounded-load placement is not supported by a replicated MetaStore")
+	}
+	// a replica that becomes the leader finishes the migration an earlier leader left
+	started := make(chan struct{})
+	raft, e := StartRaftNode(peers, id, raftDir, m.applyCommitted, func() {
+		<-started
+		if e := m.ResumeMigration(); e != nil {
+			log.Println("Could not resume the migration:", e)
+		}
+	})
+	if e != nil {
+		return e
+	}
+	m.Raft = raft
+	close(started)
+	return nil
+}
+
+// Apply a command committed through Raft. Every replica applies the same
+// commands in the same order, so all checks happen here and not before Submit.
+func (m *MetaStore) applyCommitted(entry MetaLogEntry) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	switch entry.Type {
+	case LogUpdateFile:
+		oldVersion := m.FileMetaMap[entry.FileMeta.Filename].Version
+		if oldVersion+1 != entry.FileMeta.Version {
+			return fmt.Errorf("Unexpected file Version. Yours:%d, Expected:%d, Lastest on Server:%d\n",
+				entry.FileMeta.Version, oldVersion+1, oldVersion)
+		}
+		m.FileMetaMap[entry.FileMeta.Filename] = entry.FileMeta
+	case LogRing:
+		m.BlockStoreRing = entry.Ring
+		m.noteEpochLocked(entry.Ring.Epoch)
+		m.resetPlacementsLocked()
+	case LogMigrationStart, LogMigrationCommit, LogMigrationDone, LogMigrationAbort:
+		m.applyMigrationLocked(entry)
+	}
+	return nil
+}
+
+// In a replicated MetaStore, wait until every command committed so far is
+// applied here, by committing a no-op, so a new ring is computed from the latest one
+func (m *MetaStore) catchUp() error {
+	if m.Raft == nil {
+		return nil
+	}
+	return m.Raft.Submit(MetaLogEntry{Type: LogNoop})
+}
+
+// In a replicated MetaStore, send a call made to a follower on to the leader.
+// The bool result reports whether the call was forwarded, the error is its result.
+func (m *MetaStore) forwardToLeader(serviceMethod string, args interface{}, reply interface{}) (bool, error) {
+	if m.Raft == nil {
+		return false, nil
+	}
+	isLeader, leaderAddr := m.Raft.Leader()
+	if isLeader {
+		return false, nil
+	}
+	if leaderAddr == "" {
+		return true, ErrNoLeader
+	}
+	return true, rpcCall(leaderAddr, serviceMethod, args, reply)
+}
+
 var _ MetaStoreInterface = new(MetaStore)
 
 func NewMetaStore(blockStoreRing ConsistentHashRing) MetaStore {
 	return MetaStore{
 		FileMetaMap:    map[string]FileMetaData{},
 		BlockStoreRing: blockStoreRing,
+		maxEpoch:       blockStoreRing.Epoch,
+	}
+}
+
+// Create a MetaStore that persists its state in metaDir and recovers it on restart.
+// blockStoreRing is only used when metaDir holds no earlier state.
+func NewPersistentMetaStore(blockStoreRing ConsistentHashRing, metaDir string, snapshotEvery int) (MetaStore, error) {
+	metaLog, e := OpenMetaStoreLog(metaDir, snapshotEvery)
+	if e != nil {
+		return MetaStore{}, e
 	}
+	snap, entries, e := metaLog.Recover()
+	if e != nil {
+		return MetaStore{}, e
+	}
+
+	fileMetaMap := map[string]FileMetaData{}
+	spills := map[string][]string{}
+	var migration *RingMigration
+	maxEpoch := blockStoreRing.Epoch
+	if snap == nil && len(entries) == 0 {
+		// first start, remember the initial ring
+		if e := metaLog.Append(&MetaLogEntry{Type: LogRing, Ring: blockStoreRing}); e != nil {
+			return MetaStore{}, e
+		}
+	} else {
+		if snap != nil {
+			fileMetaMap = snap.FileMetaMap
+			blockStoreRing = snap.BlockStoreRing
+			spills = snap.Spills
+			migration = snap.Migration
+			maxEpoch = snap.MaxEpoch
+		}
+		blockStoreRing, migration, maxEpoch = replayMetaLog(entries, fileMetaMap, blockStoreRing, spills, migration, maxEpoch)
+		log.Printf("Recovered %d files and %d BlockStores from %s\n", len(fileMetaMap), len(blockStoreRing.Nodes), metaDir)
+		if migration != nil {
+			log.Printf("Recovered an unfinished migration to ring epoch %d, see ResumeMigration\n", migration.NewRing.Epoch)
+		}
+	}
+	if e := blockStoreRing.Validate(); e != nil {
+		return MetaStore{}, fmt.Errorf("invalid BlockStore ring in %s: %v", metaDir, e)
+	}
+	if migration != nil {
+		if e := migration.NewRing.Validate(); e != nil {
+			return MetaStore{}, fmt.Errorf("invalid migration ring in %s: %v", metaDir, e)
+		}
+	}
+
+	return MetaStore{
+		FileMetaMap:    fileMetaMap,
+		BlockStoreRing: blockStoreRing,
+		Log:            metaLog,
+		spills:         spills,
+		migration:      migration,
+		maxEpoch:       maxEpoch,
+	}, nil
 }
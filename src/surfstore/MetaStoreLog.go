@@ -0,0 +1,321 @@
+package surfstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Kinds of MetaStore state changes recorded in the write-ahead log
+const (
+	LogUpdateFile = "UpdateFile"
+	LogRing       = "Ring"
+	LogSpill      = "Spill"
+	// Changes nothing, committed by a new Raft leader
+	LogNoop = "Noop"
+	// Steps of a two-phase ring change (see RingMigration)
+	LogMigrationStart  = "MigrationStart"
+	LogMigrationCommit = "MigrationCommit"
+	LogMigrationDone   = "MigrationDone"
+	LogMigrationAbort  = "MigrationAbort"
+)
+
+// Number of log entries after which the MetaStore snapshots its state and compacts the log
+const DefaultSnapshotEvery = 1000
+
+const (
+	walFileName      = "metastore.wal"
+	snapshotFileName = "metastore.snapshot"
+	// Upper bound on a single log record, anything larger is treated as corruption
+	maxRecordSize = 64 << 20
+	// <length><crc32> in front of every record
+	recordHeaderSize = 8
+)
+
+// A single acknowledged MetaStore state change
+type MetaLogEntry struct {
+	Index int
+	Type  string
+	// Set for LogUpdateFile entries
+	FileMeta FileMetaData
+	// Set for LogRing entries: the whole ring after the change
+	Ring ConsistentHashRing
+	// Set for LogSpill entries: a block placed off its natural hosts by bounded-load placement
+	BlockHash string
+	Hosts     []string
+	// Set for LogMigrationStart entries. LogMigrationCommit entries carry the new ring in Ring.
+	Migration RingMigration
+}
+
+// A ring change whose blocks are being moved. It is logged before the first
+// block is copied and cleared once the last one is deleted, so a MetaStore that
+// crashes in between resumes it on restart.
+type RingMigration struct {
+	OldRing ConsistentHashRing
+	NewRing ConsistentHashRing
+	// Blocks bounded-load placement spilled off their natural hosts in OldRing,
+	// moved to their hosts in NewRing. No block spills while the change runs.
+	Spills map[string][]string
+	// NewRing is the current ring and only the deletes are left
+	Committed bool
+	// BlockStores drained by the change, read-only until it is done or aborted
+	ReadOnly []string
+}
+
+// Full MetaStore state as of log entry LastIndex
+type MetaSnapshot struct {
+	LastIndex      int
+	FileMetaMap    map[string]FileMetaData
+	BlockStoreRing ConsistentHashRing
+	// Blocks spilled off their natural hosts in BlockStoreRing
+	Spills map[string][]string
+	// Ring change in flight, nil if there is none
+	Migration *RingMigration
+	// Highest ring epoch handed out, see MetaStore.maxEpoch
+	MaxEpoch int
+}
+
+// MetaStoreLog is the durable storage of a MetaStore: a snapshot file plus a
+// write-ahead log of every change made since that snapshot. Log records are
+// framed as <length><crc32><gob payload> so a torn write at the tail is detected
+// and dropped on recovery. Entries are fsynced before Append returns. A failed
+// append is cut off again, so no acknowledged record ever follows a torn one.
+type MetaStoreLog struct {
+	Dir           string
+	SnapshotEvery int
+
+	wal walFile
+	// Bytes of complete records in wal
+	walSize       int64
+	lastIndex     int
+	sinceSnapshot int
+	// Set once a failed append could not be cut off, nothing is appended after it
+	failed error
+}
+
+// The parts of *os.File the write-ahead log uses
+type walFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// Open (or create) the MetaStore log in dir
+func OpenMetaStoreLog(dir string, snapshotEvery int) (*MetaStoreLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	return &MetaStoreLog{
+		Dir:           dir,
+		SnapshotEvery: snapshotEvery,
+	}, nil
+}
+
+// Load the latest snapshot (nil if none was taken yet) and the log entries
+// written after it. Must be called once before Append.
+func (l *MetaStoreLog) Recover() (*MetaSnapshot, []MetaLogEntry, error) {
+	snap, err := l.readSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	if snap != nil {
+		l.lastIndex = snap.LastIndex
+	}
+
+	walPath := filepath.Join(l.Dir, walFileName)
+	f, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]MetaLogEntry, 0)
+	reader := bufio.NewReader(f)
+	validSize := int64(0)
+	for {
+		payload, n, err := readRecord(reader)
+		if err != nil {
+			// a torn or corrupt record can only be the tail of an interrupted append
+			break
+		}
+		var entry MetaLogEntry
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry); err != nil {
+			break
+		}
+		validSize += int64(n)
+		if entry.Index <= l.lastIndex {
+			// already covered by the snapshot
+			continue
+		}
+		entries = append(entries, entry)
+		l.lastIndex = entry.Index
+		l.sinceSnapshot++
+	}
+
+	// cut off whatever could not be decoded so new records follow valid ones
+	if err := f.Truncate(validSize); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(validSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	l.wal = f
+	l.walSize = validSize
+	return snap, entries, nil
+}
+
+// Durably append an entry to the log. The entry's Index is assigned here.
+func (l *MetaStoreLog) Append(entry *MetaLogEntry) error {
+	if l.wal == nil {
+		return fmt.Errorf("MetaStore log %s is not open", l.Dir)
+	}
+	if l.failed != nil {
+		return l.failed
+	}
+	entry.Index = l.lastIndex + 1
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(entry); err != nil {
+		return err
+	}
+	if err := writeRecord(l.wal, payload.Bytes()); err != nil {
+		return l.cutOff(err)
+	}
+	if err := l.wal.Sync(); err != nil {
+		return l.cutOff(err)
+	}
+	l.walSize += int64(recordHeaderSize + payload.Len())
+	l.lastIndex = entry.Index
+	l.sinceSnapshot++
+	return nil
+}
+
+// Remove whatever a failed append left behind the last complete record. If
+// that fails too, the log refuses every later append, as recovery would drop them.
+func (l *MetaStoreLog) cutOff(appendErr error) error {
+	err := l.wal.Truncate(l.walSize)
+	if err == nil {
+		_, err = l.wal.Seek(l.walSize, io.SeekStart)
+	}
+	if err == nil {
+		err = l.wal.Sync()
+	}
+	if err != nil {
+		l.failed = fmt.Errorf("MetaStore log %s failed: %v (cutting off the failed append: %v)", l.Dir, appendErr, err)
+		return l.failed
+	}
+	return appendErr
+}
+
+// Report whether enough entries were appended since the last snapshot to take a new one
+func (l *MetaStoreLog) NeedsSnapshot() bool {
+	return l.sinceSnapshot >= l.SnapshotEvery
+}
+
+// Persist a snapshot of the state as of the last appended entry and compact the log.
+// A crash between the two steps is harmless: entries already covered by the
+// snapshot are skipped during recovery.
+func (l *MetaStoreLog) Snapshot(fileMetaMap map[string]FileMetaData, ring ConsistentHashRing, spills map[string][]string,
+	migration *RingMigration, maxEpoch int) error {
+	snap := MetaSnapshot{
+		LastIndex:      l.lastIndex,
+		FileMetaMap:    fileMetaMap,
+		BlockStoreRing: ring,
+		Spills:         spills,
+		Migration:      migration,
+		MaxEpoch:       maxEpoch,
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&snap); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(l.Dir, snapshotFileName), buf.Bytes()); err != nil {
+		return err
+	}
+
+	// compact: every entry is now part of the snapshot
+	if err := l.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := l.wal.Sync(); err != nil {
+		return err
+	}
+	l.walSize = 0
+	l.sinceSnapshot = 0
+	return nil
+}
+
+// Close the log file
+func (l *MetaStoreLog) Close() error {
+	if l.wal == nil {
+		return nil
+	}
+	err := l.wal.Close()
+	l.wal = nil
+	return err
+}
+
+func (l *MetaStoreLog) readSnapshot() (*MetaSnapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(l.Dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap MetaSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("corrupt MetaStore snapshot: %v", err)
+	}
+	if snap.FileMetaMap == nil {
+		snap.FileMetaMap = map[string]FileMetaData{}
+	}
+	if snap.Spills == nil {
+		snap.Spills = map[string][]string{}
+	}
+	return &snap, nil
+}
+
+// Write one <length><crc32><payload> record
+func writeRecord(w io.Writer, payload []byte) error {
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// Read one record, returning its payload and the number of bytes consumed
+func readRecord(r io.Reader) ([]byte, int, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, 0, fmt.Errorf("record length %d exceeds limit", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+	return payload, len(header) + len(payload), nil
+}
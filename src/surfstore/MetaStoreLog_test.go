@@ -0,0 +1,240 @@
+package surfstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestLog(t *testing.T, dir string, snapshotEvery int) (*MetaStoreLog, *MetaSnapshot, []MetaLogEntry) {
+	t.Helper()
+	l, e := OpenMetaStoreLog(dir, snapshotEvery)
+	if e != nil {
+		t.Fatal(e)
+	}
+	snap, entries, e := l.Recover()
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, snap, entries
+}
+
+func appendUpdate(t *testing.T, l *MetaStoreLog, filename string, version int) {
+	t.Helper()
+	entry := MetaLogEntry{Type: LogUpdateFile, FileMeta: FileMetaData{Filename: filename, Version: version}}
+	if e := l.Append(&entry); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// Log entries must be numbered 1, 2, ... without gaps or repeats
+func checkEntryIndexes(t *testing.T, entries []MetaLogEntry, first int, count int) {
+	t.Helper()
+	if len(entries) != count {
+		t.Fatalf("recovered %d entries, want %d", len(entries), count)
+	}
+	for i, entry := range entries {
+		if entry.Index != first+i {
+			t.Fatalf("entry %d has index %d, want %d", i, entry.Index, first+i)
+		}
+	}
+}
+
+func openTestMetaStore(t *testing.T, dir string, snapshotEvery int) *MetaStore {
+	t.Helper()
+	store, e := NewPersistentMetaStore(NewConsistentHashRing(128, []string{"localhost:8081"}), dir, snapshotEvery)
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { store.Log.Close() })
+	return &store
+}
+
+func updateVersions(t *testing.T, store *MetaStore, filename string, versions int) {
+	t.Helper()
+	for version := 1; version <= versions; version++ {
+		latestVersion := 0
+		fileMeta := FileMetaData{Filename: filename, Version: version, BlockHashList: []string{fmt.Sprint(version)}}
+		if e := store.UpdateFile(&fileMeta, &latestVersion); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func TestPersistentMetaStoreRecoversAfterCleanRestart(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestMetaStore(t, dir, 100)
+	updateVersions(t, store, "a.txt", 3)
+	updateVersions(t, store, "b.txt", 1)
+	ring := NewConsistentHashRing(128, []string{"localhost:8081", "localhost:8082"})
+	ring.Epoch = store.nextEpoch()
+	if e := store.setRing(ring); e != nil {
+		t.Fatal(e)
+	}
+	store.Log.Close()
+
+	recovered := openTestMetaStore(t, dir, 100)
+	if version := recovered.FileMetaMap["a.txt"].Version; version != 3 {
+		t.Errorf("a.txt recovered at version %d, want 3", version)
+	}
+	if hashes := recovered.FileMetaMap["a.txt"].BlockHashList; len(hashes) != 1 || hashes[0] != "3" {
+		t.Errorf("a.txt recovered with blocks %v, want [3]", hashes)
+	}
+	if version := recovered.FileMetaMap["b.txt"].Version; version != 1 {
+		t.Errorf("b.txt recovered at version %d, want 1", version)
+	}
+	if addrs := recovered.BlockStoreRing.Addrs(); len(addrs) != 2 || recovered.BlockStoreRing.Epoch != ring.Epoch {
+		t.Errorf("recovered ring %v at epoch %d, want 2 BlockStores at epoch %d", addrs, recovered.BlockStoreRing.Epoch, ring.Epoch)
+	}
+
+	// the recovered store keeps checking versions against what it acknowledged
+	latestVersion := 0
+	if e := recovered.UpdateFile(&FileMetaData{Filename: "a.txt", Version: 3}, &latestVersion); e == nil {
+		t.Error("recovered MetaStore accepted a.txt version 3 again")
+	}
+}
+
+func TestPersistentMetaStoreRecoversAfterSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestMetaStore(t, dir, 4)
+	updateVersions(t, store, "a.txt", 10)
+	store.Log.Close()
+
+	if _, e := os.Stat(filepath.Join(dir, snapshotFileName)); e != nil {
+		t.Fatalf("no snapshot was taken: %v", e)
+	}
+	// the initial ring and 10 updates, snapshotted every 4 entries
+	_, snap, entries := openTestLog(t, dir, 4)
+	if snap == nil || snap.LastIndex != 8 {
+		t.Fatalf("snapshot %+v, want one as of entry 8", snap)
+	}
+	checkEntryIndexes(t, entries, 9, 3)
+
+	recovered := openTestMetaStore(t, dir, 4)
+	if version := recovered.FileMetaMap["a.txt"].Version; version != 10 {
+		t.Errorf("a.txt recovered at version %d, want 10", version)
+	}
+}
+
+func TestMetaStoreLogSnapshotEvery(t *testing.T) {
+	dir := t.TempDir()
+	l, _, _ := openTestLog(t, dir, 3)
+	for version := 1; version <= 2; version++ {
+		appendUpdate(t, l, "a.txt", version)
+		if l.NeedsSnapshot() {
+			t.Fatalf("snapshot needed after %d entries, want after 3", version)
+		}
+	}
+	appendUpdate(t, l, "a.txt", 3)
+	if !l.NeedsSnapshot() {
+		t.Fatal("no snapshot needed after 3 entries")
+	}
+	if e := l.Snapshot(map[string]FileMetaData{}, ConsistentHashRing{}, nil, nil, 0); e != nil {
+		t.Fatal(e)
+	}
+	if l.NeedsSnapshot() {
+		t.Fatal("snapshot still needed right after taking one")
+	}
+
+	// entries recovered from the log count toward the next snapshot
+	appendUpdate(t, l, "a.txt", 4)
+	appendUpdate(t, l, "a.txt", 5)
+	l.Close()
+	l, _, _ = openTestLog(t, dir, 3)
+	if l.NeedsSnapshot() {
+		t.Fatal("snapshot needed after 2 recovered entries, want after 3")
+	}
+	appendUpdate(t, l, "a.txt", 6)
+	if !l.NeedsSnapshot() {
+		t.Fatal("no snapshot needed after 2 recovered and 1 new entry")
+	}
+
+	if l, e := OpenMetaStoreLog(t.TempDir(), 0); e != nil || l.SnapshotEvery != DefaultSnapshotEvery {
+		t.Fatalf("unset snapshot interval is %d, want %d", l.SnapshotEvery, DefaultSnapshotEvery)
+	}
+}
+
+func TestMetaStoreLogDropsCorruptTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		// entries that survive recovery
+		kept int
+	}{
+		{"truncated record", func(data []byte) []byte { return data[:len(data)-5] }, 2},
+		{"truncated header", func(data []byte) []byte { return append(data, 0, 0, 1) }, 3},
+		{"flipped payload byte", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}, 2},
+		{"oversized length", func(data []byte) []byte { return append(data, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0) }, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, _, _ := openTestLog(t, dir, 100)
+			for version := 1; version <= 3; version++ {
+				appendUpdate(t, l, "a.txt", version)
+			}
+			l.Close()
+
+			walPath := filepath.Join(dir, walFileName)
+			data, e := ioutil.ReadFile(walPath)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if e := ioutil.WriteFile(walPath, test.corrupt(data), 0644); e != nil {
+				t.Fatal(e)
+			}
+
+			l, _, entries := openTestLog(t, dir, 100)
+			checkEntryIndexes(t, entries, 1, test.kept)
+			// records appended after recovery follow the valid ones
+			appendUpdate(t, l, "a.txt", test.kept+1)
+			l.Close()
+			_, _, entries = openTestLog(t, dir, 100)
+			checkEntryIndexes(t, entries, 1, test.kept+1)
+		})
+	}
+}
+
+// Writes half of the first record written through it, then fails
+type tornWAL struct {
+	walFile
+	torn bool
+}
+
+func (w *tornWAL) Write(p []byte) (int, error) {
+	if w.torn {
+		return w.walFile.Write(p)
+	}
+	w.torn = true
+	n, _ := w.walFile.Write(p[:len(p)/2])
+	return n, fmt.Errorf("disk full")
+}
+
+func TestMetaStoreLogCutsOffFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	l, _, _ := openTestLog(t, dir, 100)
+	appendUpdate(t, l, "a.txt", 1)
+
+	l.wal = &tornWAL{walFile: l.wal}
+	if e := l.Append(&MetaLogEntry{Type: LogUpdateFile, FileMeta: FileMetaData{Filename: "a.txt", Version: 2}}); e == nil {
+		t.Fatal("torn append succeeded")
+	}
+	// the next appends are acknowledged and must survive a restart
+	appendUpdate(t, l, "a.txt", 2)
+	appendUpdate(t, l, "a.txt", 3)
+	l.Close()
+
+	_, _, entries := openTestLog(t, dir, 100)
+	checkEntryIndexes(t, entries, 1, 3)
+	for i, entry := range entries {
+		if entry.FileMeta.Version != i+1 {
+			t.Errorf("entry %d holds version %d, want %d", entry.Index, entry.FileMeta.Version, i+1)
+		}
+	}
+}
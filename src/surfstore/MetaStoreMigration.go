@@ -0,0 +1,504 @@
+package surfstore
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Membership states of a BlockStore during a ring change
+const (
+	// In both rings
+	NodeMember = "member"
+	// Only in the new ring, receiving copies of the ranges it will host
+	NodeJoining = "joining"
+	// Only in the old ring, its ranges are copied to their new hosts
+	NodeLeaving = "leaving"
+	// Leaving and read-only, see DrainNode
+	NodeDraining = "draining"
+)
+
+// Get the membership state of addr in the ring change
+func (migration *RingMigration) MemberState(addr string) string {
+	for _, readOnly := range migration.ReadOnly {
+		if readOnly == addr {
+			return NodeDraining
+		}
+	}
+	inOld := migration.OldRing.NodeWeight(addr) > 0
+	inNew := migration.NewRing.NodeWeight(addr) > 0
+	if inNew && !inOld {
+		return NodeJoining
+	}
+	if inOld && !inNew {
+		return NodeLeaving
+	}
+	return NodeMember
+}
+
+// Move the blocks of a logged ring change in two phases. First every BlockStore
+// of either ring learns the new ring as pending, the ranges and spilled blocks
+// are copied to their new hosts and every copy is checked with HasBlocks. Only
+// then is the new ring committed, after which the old hosts drop what they no
+// longer host and the migration is marked done. Until the commit the old ring
+// stays current and GetBlockStoreMap also lists the new hosts, so no block
+// written meanwhile is lost. Every step can be repeated, so a migration
+// interrupted by a crash on either side is finished by running it again.
+// A job canceled before the commit undoes the change instead, see abortMigration.
+func (m *MetaStore) runMigration(migration RingMigration, down map[string]bool, job *migrationJob) error {
+	newRing := migration.NewRing
+	plan, e := planRingMigration(migration, down)
+	if e != nil {
+		return e
+	}
+
+	if !migration.Committed {
+		for _, collision := range newRing.Collisions() {
+			log.Printf("Ring index collision: %s token %d moved from %d to %d\n",
+				collision.Node.Addr, collision.Node.Token, collision.HashedIndex, collision.Node.Index)
+		}
+		if e := m.announceMigration(migration, down); e != nil {
+			return e
+		}
+		m.mtx.Lock()
+		m.migrationAnnounced = true
+		m.mtx.Unlock()
+		if plan.Unreachable > 0 {
+			log.Printf("%d ring indices or spilled blocks have no live copy left and are lost\n", plan.Unreachable)
+		}
+		if e := m.copyBlocks(plan, job); e == ErrMigrationCanceled {
+			return m.abortMigration(migration, down)
+		} else if e != nil {
+			return e
+		}
+		// list the blocks again, so blocks written since the copy are checked too
+		if plan, e = planRingMigration(migration, down); e != nil {
+			return e
+		}
+		if e := m.verifyCopies(plan); e != nil {
+			return e
+		}
+		if !job.commit() {
+			return m.abortMigration(migration, down)
+		}
+		if e := m.recordMigration(MetaLogEntry{Type: LogMigrationCommit, Ring: newRing}); e != nil {
+			return e
+		}
+		m.publishRing(newRing)
+	}
+
+	if e := m.executeDeletes(plan); e != nil {
+		return e
+	}
+	if e := m.recordMigration(MetaLogEntry{Type: LogMigrationDone}); e != nil {
+		return e
+	}
+	// a drained BlockStore may join again later
+	setReadOnly(migration.ReadOnly, false, down)
+	return nil
+}
+
+// Plan the block movements of a ring change. A change of ring size gives every
+// block a new ring index, so the ranges of the two rings cannot be compared and
+// the blocks are listed on the BlockStores instead, see planResize.
+func planRingMigration(migration RingMigration, down map[string]bool) (MigrationPlan, error) {
+	if migration.OldRing.RingSize != migration.NewRing.RingSize {
+		return planResize(&migration.OldRing, &migration.NewRing, migration.Spills, down)
+	}
+	return PlanMigrationAvoiding(&migration.OldRing, &migration.NewRing, migration.Spills, down), nil
+}
+
+// Plan a change of ring size. Every BlockStore of the old ring lists all its
+// blocks, and each block is copied to its hosts in the new ring that did not host
+// it before, from the old host chooseSource picks. Once the new ring is
+// committed, every BlockStore drops the blocks it does not host in it.
+// Spilled blocks are found on the hosts in spills.
+func planResize(oldRing *ConsistentHashRing, newRing *ConsistentHashRing, spills map[string][]string, down map[string]bool) (MigrationPlan, error) {
+	copies := newTransferBuilder()
+	for _, addr := range oldRing.Addrs() {
+		if down[addr] {
+			continue
+		}
+		blockHashes := make([]string, 0)
+		// upper index -1 is the top of the ring, whatever size the BlockStore uses
+		if e := rpcCall(addr, "BlockStore.ListBlocks", MigrationInstruction{LowerIndex: 0, UpperIndex: -1}, &blockHashes); e != nil {
+			return MigrationPlan{}, e
+		}
+		sort.Strings(blockHashes)
+		for _, blockHash := range blockHashes {
+			oldAddrs := nodeAddrs(findPlacedHosts(oldRing, spills, blockHash))
+			newAddrs := nodeAddrs(newRing.FindBlockHosts(blockHash))
+			oldSet := addrSet(oldAddrs)
+			if chooseSource(oldAddrs, addrSet(newAddrs), down) != addr {
+				continue
+			}
+			for _, destAddr := range newAddrs {
+				if !oldSet[destAddr] && !down[destAddr] {
+					copies.add(addr, destAddr, blockHash)
+				}
+			}
+		}
+	}
+	return MigrationPlan{
+		Copies:       []MigrationStep{},
+		Deletes:      []MigrationStep{},
+		BlockCopies:  copies.steps,
+		BlockDeletes: []TransferStep{},
+		Rehashes:     rehashSteps(*newRing, nil, append(oldRing.Addrs(), newRing.Addrs()...), down),
+	}, nil
+}
+
+// Have every BlockStore at addrs that is not down drop the blocks it does not
+// host in ring, keeping those spills places on it
+func rehashSteps(ring ConsistentHashRing, spills map[string][]string, addrs []string, down map[string]bool) []RehashInstruction {
+	spilled := make(map[string][]string)
+	for blockHash, hosts := range spills {
+		for _, addr := range hosts {
+			spilled[addr] = append(spilled[addr], blockHash)
+		}
+	}
+	steps := make([]RehashInstruction, 0)
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if !seen[addr] && !down[addr] {
+			seen[addr] = true
+			steps = append(steps, RehashInstruction{Ring: ring, SelfAddr: addr, Keep: spilled[addr]})
+		}
+	}
+	return steps
+}
+
+// Finish the migration left by an earlier membership change, if any.
+// Caller must hold membershipMtx.
+func (m *MetaStore) resumeMigration(down map[string]bool) error {
+	m.mtx.RLock()
+	pending := m.migration
+	m.mtx.RUnlock()
+	if pending == nil {
+		return nil
+	}
+	log.Printf("Resuming the migration to ring epoch %d\n", pending.NewRing.Epoch)
+	if e := m.runMigration(*pending, down, nil); e != nil {
+		return fmt.Errorf("unfinished migration to ring epoch %d: %v", pending.NewRing.Epoch, e)
+	}
+	return nil
+}
+
+// Finish a migration interrupted by a crash of the MetaStore or of a BlockStore.
+// Does nothing if no migration is pending. Every membership change also resumes
+// a pending migration before it starts.
+func (m *MetaStore) ResumeMigration() error {
+	m.membershipMtx.Lock()
+	defer m.membershipMtx.Unlock()
+	if e := m.catchUp(); e != nil {
+		return e
+	}
+	return m.resumeMigration(m.deadNodes())
+}
+
+// Send the old ring and the new one as pending to the BlockStores of both rings,
+// so they accept the blocks clients write to their new hosts during the copy and
+// know where to read the blocks they miss, and tell the joining BlockStores the
+// ring size. The drained BlockStores are made read-only.
+func (m *MetaStore) announceMigration(migration RingMigration, down map[string]bool) error {
+	addrs := addrSet(migration.OldRing.Addrs())
+	for _, addr := range migration.NewRing.Addrs() {
+		addrs[addr] = true
+		if migration.OldRing.NodeWeight(addr) > 0 || down[addr] {
+			continue
+		}
+		sizeSucc := false
+		if e := rpcCall(addr, "BlockStore.SetRingSize", migration.NewRing.RingSize, &sizeSucc); e != nil {
+			return e
+		}
+	}
+	for addr := range addrs {
+		if down[addr] {
+			continue
+		}
+		for _, update := range []RingUpdate{
+			{Ring: migration.OldRing, SelfAddr: addr},
+			{Ring: migration.NewRing, SelfAddr: addr, Pending: true},
+		} {
+			succ := false
+			if e := rpcCall(addr, "BlockStore.SetRing", update, &succ); e != nil {
+				return e
+			}
+		}
+	}
+	for _, addr := range migration.ReadOnly {
+		if down[addr] {
+			continue
+		}
+		succ := false
+		if e := rpcCall(addr, "BlockStore.SetReadOnly", true, &succ); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Make the BlockStores at addrs that are not down read-only or writable, logging the failures
+func setReadOnly(addrs []string, readOnly bool, down map[string]bool) {
+	for _, addr := range addrs {
+		if down[addr] {
+			continue
+		}
+		succ := false
+		if e := rpcCall(addr, "BlockStore.SetReadOnly", readOnly, &succ); e != nil {
+			log.Printf("Could not set BlockStore %s read-only %t: %v\n", addr, readOnly, e)
+		}
+	}
+}
+
+// Log a migration entry and apply it, through Raft in a replicated MetaStore
+func (m *MetaStore) recordMigration(entry MetaLogEntry) error {
+	if m.Raft != nil {
+		return m.Raft.Submit(entry)
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if e := m.logEntry(entry); e != nil {
+		return e
+	}
+	m.applyMigrationLocked(entry)
+	m.maybeSnapshot()
+	return nil
+}
+
+// Apply a logged migration entry. Caller must hold m.mtx.
+func (m *MetaStore) applyMigrationLocked(entry MetaLogEntry) {
+	switch entry.Type {
+	case LogMigrationStart:
+		migration := entry.Migration
+		m.migration = &migration
+		m.migrationAnnounced = false
+		m.noteEpochLocked(migration.NewRing.Epoch)
+	case LogMigrationCommit:
+		m.BlockStoreRing = entry.Ring
+		m.resetPlacementsLocked()
+		if m.migration != nil {
+			m.migration.Committed = true
+		}
+	case LogMigrationDone, LogMigrationAbort:
+		m.migration = nil
+		m.migrationAnnounced = false
+	}
+}
+
+// While the blocks of a migration are copied, also list every block under its
+// hosts in the new ring, so that blocks written during the copy reach them, and
+// leave out the drained BlockStores, which accept no new blocks. Their blocks
+// are read through the new hosts meanwhile. Nothing changes until the new hosts
+// know the pending ring, as they would reject the blocks. Caller must hold m.mtx.
+func (m *MetaStore) addMigrationHostsLocked(blockHashes []string, blockStoreMap map[string][]string) {
+	if m.migration == nil || m.migration.Committed || !m.migrationAnnounced {
+		return
+	}
+	listed := make(map[[2]string]bool)
+	for addr, hashes := range blockStoreMap {
+		for _, hash := range hashes {
+			listed[[2]string{addr, hash}] = true
+		}
+	}
+	for _, hash := range blockHashes {
+		for _, node := range m.migration.NewRing.FindBlockHosts(hash) {
+			key := [2]string{node.Addr, hash}
+			if !listed[key] {
+				listed[key] = true
+				blockStoreMap[node.Addr] = append(blockStoreMap[node.Addr], hash)
+			}
+		}
+	}
+	for _, addr := range m.migration.ReadOnly {
+		delete(blockStoreMap, addr)
+	}
+}
+
+// Run a migration plan against the BlockStores: all copies first, then all deletes
+func (m *MetaStore) executeMigration(plan MigrationPlan) error {
+	if e := m.copyBlocks(plan, nil); e != nil {
+		return e
+	}
+	return m.executeDeletes(plan)
+}
+
+// Copy the blocks of the ranges and spilled blocks of a plan to their new hosts,
+// migrationChunkBlocks at a time, reporting the progress to job. Stops with
+// ErrMigrationCanceled between two chunks once job is canceled.
+func (m *MetaStore) copyBlocks(plan MigrationPlan, job *migrationJob) error {
+	transfers := make([]TransferStep, 0, len(plan.Copies)+len(plan.BlockCopies))
+	for _, step := range plan.Copies {
+		blockHashes := make([]string, 0)
+		if e := rpcCall(step.SrcAddr, "BlockStore.ListBlocks", step.Inst, &blockHashes); e != nil {
+			return e
+		}
+		log.Printf("Copy [%d, %d] (%d blocks) from %s to %s\n", step.Inst.LowerIndex, step.Inst.UpperIndex, len(blockHashes), step.SrcAddr, step.Inst.DestAddr)
+		transfers = append(transfers, TransferStep{SrcAddr: step.SrcAddr, Transfer: BlockTransfer{BlockHashes: blockHashes, DestAddr: step.Inst.DestAddr}})
+	}
+	for _, step := range plan.BlockCopies {
+		log.Printf("Copy %d blocks from %s to %s\n", len(step.Transfer.BlockHashes), step.SrcAddr, step.Transfer.DestAddr)
+		transfers = append(transfers, step)
+	}
+	for _, step := range transfers {
+		job.addRemaining(len(step.Transfer.BlockHashes))
+	}
+
+	for _, step := range transfers {
+		blockHashes := step.Transfer.BlockHashes
+		for start := 0; start < len(blockHashes); start += migrationChunkBlocks {
+			if job.canceled() {
+				return ErrMigrationCanceled
+			}
+			end := start + migrationChunkBlocks
+			if end > len(blockHashes) {
+				end = len(blockHashes)
+			}
+			transfer := BlockTransfer{BlockHashes: blockHashes[start:end], DestAddr: step.Transfer.DestAddr, Options: m.TransferOptions}
+			stats := TransferStats{}
+			if e := rpcCall(step.SrcAddr, "BlockStore.CopyBlocks", transfer, &stats); e != nil {
+				return e
+			}
+			job.addProgress(end-start, stats)
+		}
+	}
+	return nil
+}
+
+// Undo a ring change whose copy was canceled: log the abort, so the old ring
+// stays current, withdraw the pending ring from the BlockStores and drop the
+// copies already made on the hosts of the new ring. The drained BlockStores are
+// made writable first and get back the blocks clients wrote to the new hosts
+// of their ranges in the meantime.
+func (m *MetaStore) abortMigration(migration RingMigration, down map[string]bool) error {
+	log.Printf("Aborting the migration to ring epoch %d\n", migration.NewRing.Epoch)
+	setReadOnly(migration.ReadOnly, false, down)
+	if e := m.recordMigration(MetaLogEntry{Type: LogMigrationAbort}); e != nil {
+		return e
+	}
+	addrs := addrSet(migration.OldRing.Addrs())
+	for _, addr := range migration.NewRing.Addrs() {
+		addrs[addr] = true
+	}
+	for addr := range addrs {
+		if down[addr] {
+			continue
+		}
+		succ := false
+		if e := rpcCall(addr, "BlockStore.SetRing", RingUpdate{Ring: migration.OldRing, SelfAddr: addr, Pending: true}, &succ); e != nil {
+			log.Printf("Could not withdraw the pending ring from %s: %v\n", addr, e)
+		}
+	}
+	var undo MigrationPlan
+	if migration.OldRing.RingSize != migration.NewRing.RingSize {
+		// every BlockStore drops the blocks it does not host in the old ring
+		undo = MigrationPlan{Rehashes: rehashSteps(migration.OldRing, migration.Spills, append(migration.OldRing.Addrs(), migration.NewRing.Addrs()...), down)}
+	} else {
+		undo = PlanMigrationAvoiding(&migration.NewRing, &migration.OldRing, nil, down)
+	}
+	if len(migration.ReadOnly) > 0 {
+		drained := addrSet(migration.ReadOnly)
+		copyBack := MigrationPlan{}
+		for _, step := range undo.Copies {
+			if drained[step.Inst.DestAddr] {
+				copyBack.Copies = append(copyBack.Copies, step)
+			}
+		}
+		if e := m.copyBlocks(copyBack, nil); e != nil {
+			return e
+		}
+	}
+	if e := m.executeDeletes(undo); e != nil {
+		return e
+	}
+	return ErrMigrationCanceled
+}
+
+func (m *MetaStore) executeDeletes(plan MigrationPlan) error {
+	for _, step := range plan.Deletes {
+		log.Printf("Delete [%d, %d] from %s\n", step.Inst.LowerIndex, step.Inst.UpperIndex, step.SrcAddr)
+		succ := false
+		if e := rpcCall(step.SrcAddr, "BlockStore.DeleteBlocks", step.Inst, &succ); e != nil {
+			return e
+		}
+	}
+	for _, step := range plan.BlockDeletes {
+		log.Printf("Delete %d blocks from %s\n", len(step.Transfer.BlockHashes), step.SrcAddr)
+		succ := false
+		if e := rpcCall(step.SrcAddr, "BlockStore.DropBlocks", step.Transfer.BlockHashes, &succ); e != nil {
+			return e
+		}
+	}
+	for _, inst := range plan.Rehashes {
+		log.Printf("Delete the blocks %s does not host in the ring of size %d\n", inst.SelfAddr, inst.Ring.RingSize)
+		succ := false
+		if e := rpcCall(inst.SelfAddr, "BlockStore.CommitRehash", inst, &succ); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Check with HasBlocks that the destination of every copy holds all the blocks
+// the source holds. Blocks found missing, e.g. written to the source after its
+// range was copied, are copied once more before the check fails.
+func (m *MetaStore) verifyCopies(plan MigrationPlan) error {
+	for _, step := range plan.Copies {
+		blockHashes := make([]string, 0)
+		if e := rpcCall(step.SrcAddr, "BlockStore.ListBlocks", step.Inst, &blockHashes); e != nil {
+			return e
+		}
+		if e := m.verifyCopy(step.SrcAddr, step.Inst.DestAddr, blockHashes); e != nil {
+			return e
+		}
+	}
+	for _, step := range plan.BlockCopies {
+		blockHashes := make([]string, 0)
+		if e := rpcCall(step.SrcAddr, "BlockStore.HasBlocks", step.Transfer.BlockHashes, &blockHashes); e != nil {
+			return e
+		}
+		if e := m.verifyCopy(step.SrcAddr, step.Transfer.DestAddr, blockHashes); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Check that destAddr holds blockHashes, copying the missing ones from srcAddr once
+func (m *MetaStore) verifyCopy(srcAddr string, destAddr string, blockHashes []string) error {
+	missing, e := missingBlocks(destAddr, blockHashes)
+	if e != nil || len(missing) == 0 {
+		return e
+	}
+	log.Printf("Copy %d missing blocks from %s to %s again\n", len(missing), srcAddr, destAddr)
+	succ := false
+	if e := rpcCall(srcAddr, "BlockStore.TransferBlocks", BlockTransfer{BlockHashes: missing, DestAddr: destAddr, Options: m.TransferOptions}, &succ); e != nil {
+		return e
+	}
+	if missing, e = missingBlocks(destAddr, missing); e != nil {
+		return e
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d blocks copied from %s are missing on %s", len(missing), srcAddr, destAddr)
+	}
+	return nil
+}
+
+// Get the blocks among blockHashes that addr does not hold
+func missingBlocks(addr string, blockHashes []string) ([]string, error) {
+	held := make([]string, 0)
+	if e := rpcCall(addr, "BlockStore.HasBlocks", blockHashes, &held); e != nil {
+		return nil, e
+	}
+	heldSet := make(map[string]bool, len(held))
+	for _, blockHash := range held {
+		heldSet[blockHash] = true
+	}
+	missing := make([]string, 0)
+	for _, blockHash := range blockHashes {
+		if !heldSet[blockHash] {
+			missing = append(missing, blockHash)
+		}
+	}
+	return missing, nil
+}
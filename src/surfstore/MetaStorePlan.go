@@ -0,0 +1,157 @@
+package surfstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Apply the additions, then the removals of a membership change to ring
+func (change MembershipChange) apply(ring *ConsistentHashRing) error {
+	if len(change.Add) == 0 && len(change.Remove) == 0 {
+		return fmt.Errorf("no BlockStore to add or remove")
+	}
+	listed := make(map[string]bool)
+	for _, addr := range change.addrs() {
+		if listed[addr] {
+			return fmt.Errorf("BlockStore %s is listed more than once", addr)
+		}
+		listed[addr] = true
+	}
+	for _, nodeInfo := range change.Add {
+		if nodeInfo.Weight < 0 {
+			return fmt.Errorf("invalid weight %d for %s", nodeInfo.Weight, nodeInfo.Addr)
+		}
+		if e := ring.AddWeightedNode(nodeInfo.Addr, nodeInfo.Weight); e != nil {
+			return e
+		}
+	}
+	for _, addr := range change.Remove {
+		if e := ring.RemoveNode(addr); e != nil {
+			return e
+		}
+	}
+	if len(ring.Nodes) == 0 {
+		return fmt.Errorf("cannot remove every BlockStore, their blocks would have nowhere to go")
+	}
+	return nil
+}
+
+// The BlockStores added and removed by a membership change
+func (change MembershipChange) addrs() []string {
+	addrs := make([]string, 0, len(change.Add)+len(change.Remove))
+	for _, nodeInfo := range change.Add {
+		addrs = append(addrs, nodeInfo.Addr)
+	}
+	return append(addrs, change.Remove...)
+}
+
+// Describe a membership change, e.g. "add localhost:8081, localhost:8082; remove localhost:8083"
+func (change MembershipChange) String() string {
+	parts := make([]string, 0, 2)
+	if len(change.Add) > 0 {
+		addrs := make([]string, 0, len(change.Add))
+		for _, nodeInfo := range change.Add {
+			addrs = append(addrs, nodeInfo.Addr)
+		}
+		parts = append(parts, "add "+strings.Join(addrs, ", "))
+	}
+	if len(change.Remove) > 0 {
+		parts = append(parts, "remove "+strings.Join(change.Remove, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Apply a batch of additions and removals as a single ring change. The blocks
+// move once, straight from the current ring to the final one, in a migration
+// job like that of AddNode, see GetMigrationStatus.
+func (m *MetaStore) ChangeMembership(change MembershipChange, succ *bool) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.ChangeMembership", change, succ); forwarded {
+		return e
+	}
+	if _, e := m.startRingChange(change.String(), change.apply, m.deadNodes(), nil); e != nil {
+		return e
+	}
+	*succ = true
+	return nil
+}
+
+// Compute what a membership change would do without changing anything: the
+// resulting ring, the instructions the MetaStore would send and the blocks and
+// bytes each BlockStore would copy to each other one, as counted by the sources.
+// Dead BlockStores are left out like in a real change.
+func (m *MetaStore) PlanMembership(change MembershipChange, plan *RebalancePlan) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.PlanMembership", change, plan); forwarded {
+		return e
+	}
+	m.mtx.RLock()
+	oldRing := m.BlockStoreRing.Copy()
+	spills := copySpills(m.spills)
+	migration := m.migration
+	m.mtx.RUnlock()
+	if migration != nil {
+		return fmt.Errorf("the migration to ring epoch %d is not done yet, plan once it is", migration.NewRing.Epoch)
+	}
+
+	newRing := oldRing.Copy()
+	if e := change.apply(&newRing); e != nil {
+		return e
+	}
+	newRing.Epoch = m.nextEpoch()
+	migrationPlan := PlanMigrationAvoiding(&oldRing, &newRing, spills, m.deadNodes())
+	transfers, e := measureTransfers(migrationPlan)
+	if e != nil {
+		return e
+	}
+	*plan = RebalancePlan{
+		Ring:      newRing,
+		Migration: migrationPlan,
+		Transfers: transfers,
+	}
+	return nil
+}
+
+// Ask the sources of the copies of a plan how many blocks and bytes they would
+// send, summed per source and destination
+func measureTransfers(plan MigrationPlan) ([]PlannedTransfer, error) {
+	totals := make(map[[2]string]*PlannedTransfer)
+	add := func(srcAddr string, destAddr string, blockHashes []string) error {
+		stats := TransferStats{}
+		if e := rpcCall(srcAddr, "BlockStore.MeasureBlocks", blockHashes, &stats); e != nil {
+			return e
+		}
+		key := [2]string{srcAddr, destAddr}
+		if totals[key] == nil {
+			totals[key] = &PlannedTransfer{SrcAddr: srcAddr, DestAddr: destAddr}
+		}
+		totals[key].Blocks += stats.Blocks
+		totals[key].Bytes += stats.Bytes
+		return nil
+	}
+	for _, step := range plan.Copies {
+		blockHashes := make([]string, 0)
+		if e := rpcCall(step.SrcAddr, "BlockStore.ListBlocks", step.Inst, &blockHashes); e != nil {
+			return nil, e
+		}
+		if e := add(step.SrcAddr, step.Inst.DestAddr, blockHashes); e != nil {
+			return nil, e
+		}
+	}
+	for _, step := range plan.BlockCopies {
+		if e := add(step.SrcAddr, step.Transfer.DestAddr, step.Transfer.BlockHashes); e != nil {
+			return nil, e
+		}
+	}
+
+	transfers := make([]PlannedTransfer, 0, len(totals))
+	for _, transfer := range totals {
+		transfers = append(transfers, *transfer)
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].SrcAddr != transfers[j].SrcAddr {
+			return transfers[i].SrcAddr < transfers[j].SrcAddr
+		}
+		return transfers[i].DestAddr < transfers[j].DestAddr
+	})
+	return transfers, nil
+}
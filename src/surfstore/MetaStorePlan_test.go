@@ -0,0 +1,113 @@
+package surfstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanMembershipCountsWhatTheChangeCopies(t *testing.T) {
+	addrs, _ := startBlockStores(t, 3, 128)
+	store := newRingMetaStore(t, addrs[:2], 1)
+	hashes := putBlocksThrough(t, store, 100)
+	oldRing := store.BlockStoreRing.Copy()
+
+	change := MembershipChange{Add: []NodeInfo{{Addr: addrs[2], Weight: 1}}}
+	plan := RebalancePlan{}
+	if e := store.PlanMembership(change, &plan); e != nil {
+		t.Fatal(e)
+	}
+	if members := store.BlockStoreRing.Addrs(); len(members) != 2 || store.migration != nil {
+		t.Fatalf("planning changed the ring to %v", members)
+	}
+	if plan.Ring.Epoch <= oldRing.Epoch || len(plan.Ring.Addrs()) != 3 {
+		t.Fatalf("planned ring %v at epoch %d, want 3 BlockStores after epoch %d", plan.Ring.Addrs(), plan.Ring.Epoch, oldRing.Epoch)
+	}
+
+	// every block whose host changes is copied from its old host to its new one
+	want := make(map[PlannedTransfer]bool)
+	totals := make(map[[2]string]*PlannedTransfer)
+	for i, hash := range hashes {
+		srcAddr := oldRing.FindBlockHosts(hash)[0].Addr
+		destAddr := plan.Ring.FindBlockHosts(hash)[0].Addr
+		if srcAddr == destAddr {
+			continue
+		}
+		key := [2]string{srcAddr, destAddr}
+		if totals[key] == nil {
+			totals[key] = &PlannedTransfer{SrcAddr: srcAddr, DestAddr: destAddr}
+		}
+		totals[key].Blocks++
+		totals[key].Bytes += testBlock(i).BlockSize
+	}
+	copied := 0
+	for _, transfer := range totals {
+		want[*transfer] = true
+		copied += transfer.Blocks
+	}
+	got := make(map[PlannedTransfer]bool)
+	for _, transfer := range plan.Transfers {
+		got[transfer] = true
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("planned transfers %v, want %v", plan.Transfers, totals)
+	}
+
+	// the change itself copies exactly the planned blocks to the new BlockStore
+	succ := false
+	if e := store.ChangeMembership(change, &succ); e != nil {
+		t.Fatal(e)
+	}
+	if status, e := store.WaitForMigration(0); e != nil || status.State != MigrationDone {
+		t.Fatalf("change: %+v %v", status, e)
+	}
+	missing, e := missingBlocks(addrs[2], hashes)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if held := len(hashes) - len(missing); held != copied {
+		t.Errorf("%s holds %d blocks, the plan copies %d", addrs[2], held, copied)
+	}
+}
+
+func TestChangeMembershipMovesBlocksInOneMigration(t *testing.T) {
+	addrs, _ := startBlockStores(t, 4, 128)
+	store := newRingMetaStore(t, addrs[:2], 2)
+	hashes := putBlocksThrough(t, store, 100)
+
+	invalid := []MembershipChange{
+		{},
+		{Add: []NodeInfo{{Addr: addrs[2]}}, Remove: []string{addrs[2]}},
+		{Add: []NodeInfo{{Addr: addrs[0]}}},
+		{Remove: addrs[:2]},
+	}
+	for _, change := range invalid {
+		succ := false
+		if e := store.ChangeMembership(change, &succ); e == nil {
+			t.Fatalf("invalid change %+v was applied", change)
+		}
+	}
+	if members := store.BlockStoreRing.Addrs(); len(members) != 2 {
+		t.Fatalf("an invalid change left the ring %v", members)
+	}
+
+	change := MembershipChange{Add: []NodeInfo{{Addr: addrs[2]}, {Addr: addrs[3], Weight: 2}}, Remove: []string{addrs[0]}}
+	succ := false
+	if e := store.ChangeMembership(change, &succ); e != nil {
+		t.Fatal(e)
+	}
+	status, e := store.WaitForMigration(0)
+	if e != nil || status.State != MigrationDone {
+		t.Fatalf("change: %+v %v", status, e)
+	}
+	// the failed changes are listed as failed jobs before it
+	if status.Id != len(invalid)+1 {
+		t.Errorf("the change ran as migration %d, want a single migration after %d failed ones", status.Id, len(invalid))
+	}
+	if members := store.BlockStoreRing.Addrs(); !reflect.DeepEqual(addrSet(members), addrSet(addrs[1:])) {
+		t.Fatalf("ring is %v, want %v", members, addrs[1:])
+	}
+	if weight := store.BlockStoreRing.NodeWeight(addrs[3]); weight != 2 {
+		t.Errorf("%s joined with weight %d, want 2", addrs[3], weight)
+	}
+	checkBlocksOnHosts(t, store, hashes)
+}
@@ -0,0 +1,369 @@
+package surfstore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clients race to update the same file: every version is taken exactly once
+func TestMetaStoreConcurrentUpdateFile(t *testing.T) {
+	const workers = 8
+	const updatesPerWorker = 25
+	store := NewMetaStore(NewConsistentHashRing(128, []string{"localhost:8081"}))
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			own := fmt.Sprintf("file%d", w)
+			for updated := 0; updated < updatesPerWorker; {
+				files := make(map[string]FileMetaData)
+				succ := false
+				if e := store.GetFileInfoMap(&succ, &files); e != nil {
+					t.Errorf("GetFileInfoMap: %v", e)
+					return
+				}
+				shared := FileMetaData{Filename: "shared", Version: files["shared"].Version + 1, BlockHashList: []string{own}}
+				latestVersion := 0
+				if e := store.UpdateFile(&shared, &latestVersion); e == nil {
+					updated++
+				} else if latestVersion < shared.Version-1 {
+					t.Errorf("UpdateFile rejected version %d with the latest version at %d", shared.Version, latestVersion)
+					return
+				}
+
+				ownFile := FileMetaData{Filename: own, Version: files[own].Version + 1, BlockHashList: []string{own}}
+				if e := store.UpdateFile(&ownFile, &latestVersion); e != nil {
+					t.Errorf("UpdateFile of %s: %v", own, e)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	files := make(map[string]FileMetaData)
+	succ := false
+	if e := store.GetFileInfoMap(&succ, &files); e != nil {
+		t.Fatal(e)
+	}
+	if version := files["shared"].Version; version != workers*updatesPerWorker {
+		t.Fatalf("shared file is at version %d, want %d", version, workers*updatesPerWorker)
+	}
+	for w := 0; w < workers; w++ {
+		if version := files[fmt.Sprintf("file%d", w)].Version; version < updatesPerWorker {
+			t.Errorf("file%d is at version %d, want at least %d", w, version, updatesPerWorker)
+		}
+	}
+}
+
+// Store a block on every host GetBlockStoreMap lists, fetching a new map when a
+// BlockStore reports that the ring changed under the client
+func putThroughMetaStore(store *MetaStore, block Block) error {
+	blockHash := GetBlockHashString(block.BlockData)
+	var e error
+	for attempt := 0; attempt < 10; attempt++ {
+		blockStoreMap := make(map[string][]string)
+		if e = store.GetBlockStoreMap([]string{blockHash}, &blockStoreMap); e != nil {
+			return e
+		}
+		e = nil
+		for addr := range blockStoreMap {
+			succ := false
+			if e = rpcCall(addr, "BlockStore.PutBlock", block, &succ); e != nil {
+				break
+			}
+		}
+		if _, wrongOwner := ParseWrongOwnerError(e); !wrongOwner {
+			return e
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return e
+}
+
+// Start a membership change, waiting while another migration is still running
+func addNodeWhenIdle(store *MetaStore, addr string) error {
+	for {
+		succ := false
+		e := store.AddNode(NodeInfo{Addr: addr, Weight: 1}, &succ)
+		if e == nil || !strings.Contains(e.Error(), "is still running") {
+			return e
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// BlockStores join while clients keep uploading blocks and asking for BlockStore maps
+func TestMetaStoreConcurrentAddNodeAndGetBlockStoreMap(t *testing.T) {
+	const initial = 2
+	addrs, _ := startBlockStores(t, initial+4, 128)
+	ring := NewConsistentHashRing(128, addrs[:initial])
+	ring.Replicas = 2
+	store := NewMetaStore(ring)
+	for _, addr := range addrs[:initial] {
+		succ := false
+		if e := rpcCall(addr, "BlockStore.SetRing", RingUpdate{Ring: ring, SelfAddr: addr}, &succ); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	var mtx sync.Mutex
+	blockHashes := make([]string, 0)
+	var wg sync.WaitGroup
+	for _, addr := range addrs[initial:] {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if e := addNodeWhenIdle(&store, addr); e != nil {
+				t.Errorf("AddNode %s: %v", addr, e)
+			}
+		}(addr)
+	}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				block := testBlock(w*100 + i)
+				if e := putThroughMetaStore(&store, block); e != nil {
+					t.Errorf("PutBlock: %v", e)
+					return
+				}
+				mtx.Lock()
+				blockHashes = append(blockHashes, GetBlockHashString(block.BlockData))
+				mtx.Unlock()
+			}
+		}(w)
+	}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				blockHash := GetBlockHashString(testBlock(i).BlockData)
+				blockStoreMap := make(map[string][]string)
+				if e := store.GetBlockStoreMap([]string{blockHash}, &blockStoreMap); e != nil {
+					t.Errorf("GetBlockStoreMap: %v", e)
+					return
+				}
+				if len(blockStoreMap) < ring.Replicas {
+					t.Errorf("block listed under %d BlockStores, want at least %d", len(blockStoreMap), ring.Replicas)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	for id := 1; id <= len(addrs)-initial; id++ {
+		status, e := store.WaitForMigration(id)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if status.State != MigrationDone {
+			t.Fatalf("migration %d (%s) is %s: %s", id, status.Change, status.State, status.Error)
+		}
+	}
+	if members := len(store.BlockStoreRing.Addrs()); members != len(addrs) {
+		t.Fatalf("ring has %d BlockStores, want %d", members, len(addrs))
+	}
+
+	blockStoreMap := make(map[string][]string)
+	if e := store.GetBlockStoreMap(blockHashes, &blockStoreMap); e != nil {
+		t.Fatal(e)
+	}
+	for addr, hashes := range blockStoreMap {
+		missing, e := missingBlocks(addr, hashes)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(missing) > 0 {
+			t.Errorf("%s misses %d of its %d blocks", addr, len(missing), len(hashes))
+		}
+	}
+}
+
+// A MetaStore over a ring of the BlockStores at addrs, which are told the ring
+func newRingMetaStore(t *testing.T, addrs []string, replicas int) *MetaStore {
+	t.Helper()
+	ring := NewConsistentHashRing(128, addrs)
+	ring.Replicas = replicas
+	for _, addr := range addrs {
+		succ := false
+		if e := rpcCall(addr, "BlockStore.SetRing", RingUpdate{Ring: ring, SelfAddr: addr}, &succ); e != nil {
+			t.Fatal(e)
+		}
+	}
+	store := NewMetaStore(ring)
+	return &store
+}
+
+// Store test blocks 0 to n-1 through the MetaStore and get their hashes
+func putBlocksThrough(t *testing.T, store *MetaStore, n int) []string {
+	t.Helper()
+	hashes := make([]string, n)
+	for i := range hashes {
+		block := testBlock(i)
+		if e := putThroughMetaStore(store, block); e != nil {
+			t.Fatal(e)
+		}
+		hashes[i] = GetBlockHashString(block.BlockData)
+	}
+	return hashes
+}
+
+// Check that every host GetBlockStoreMap lists for a block holds it
+func checkBlocksOnHosts(t *testing.T, store *MetaStore, hashes []string) {
+	t.Helper()
+	blockStoreMap := make(map[string][]string)
+	if e := store.GetBlockStoreMap(hashes, &blockStoreMap); e != nil {
+		t.Fatal(e)
+	}
+	for addr, hostedHashes := range blockStoreMap {
+		missing, e := missingBlocks(addr, hostedHashes)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(missing) > 0 {
+			t.Errorf("%s misses %d of its %d blocks", addr, len(missing), len(hostedHashes))
+		}
+	}
+}
+
+// Drain a BlockStore with copies throttled, so that it can be watched while still copying
+func startSlowDrain(t *testing.T) ([]string, *MetaStore, []string) {
+	t.Helper()
+	addrs, _ := startBlockStores(t, 3, 128)
+	store := newRingMetaStore(t, addrs, 1)
+	hashes := putBlocksThrough(t, store, 60)
+	store.TransferOptions = TransferOptions{BatchBytes: 1, Parallelism: 1, BytesPerSecond: 200}
+	hosted := blockHostedBy(store, addrs[0])
+	succ := false
+	if e := store.DrainNode(addrs[0], &succ); e != nil {
+		t.Fatal(e)
+	}
+	// clients can no longer write to the drained BlockStore
+	waitUntil(t, addrs[0]+" is read-only", func() bool {
+		succ := false
+		return rpcCall(addrs[0], "BlockStore.PutBlock", hosted, &succ) != nil
+	})
+	return addrs, store, hashes
+}
+
+func TestDrainNodeCopiesBlocksBeforeRemoving(t *testing.T) {
+	addrs, store, hashes := startSlowDrain(t)
+	store.mtx.RLock()
+	members := store.BlockStoreRing.Addrs()
+	store.mtx.RUnlock()
+	if len(members) != 3 {
+		t.Fatalf("ring is %v while the drained BlockStore is still copying, want it unchanged", members)
+	}
+	status, e := store.WaitForMigration(0)
+	if e != nil || status.State != MigrationDone {
+		t.Fatalf("drain: %+v %v", status, e)
+	}
+	for _, addr := range store.BlockStoreRing.Addrs() {
+		if addr == addrs[0] {
+			t.Fatalf("drained %s is still in the ring", addr)
+		}
+	}
+	checkBlocksOnHosts(t, store, hashes)
+
+	succ := false
+	if e := store.DrainNode(freeAddrs(t, 1)[0], &succ); e == nil {
+		t.Error("an unreachable BlockStore was drained")
+	}
+}
+
+func TestCanceledDrainLeavesNodeWritable(t *testing.T) {
+	addrs, store, hashes := startSlowDrain(t)
+	succ := false
+	if e := store.CancelMigration(0, &succ); e != nil {
+		t.Fatal(e)
+	}
+	status, e := store.WaitForMigration(0)
+	if e != nil || status.State != MigrationCanceled {
+		t.Fatalf("canceled drain: %+v %v", status, e)
+	}
+	if members := store.BlockStoreRing.Addrs(); len(members) != 3 {
+		t.Fatalf("ring is %v after the drain was canceled, want it unchanged", members)
+	}
+	checkBlocksOnHosts(t, store, hashes)
+
+	// a block the drained BlockStore hosts can be written to it again
+	if e := putThroughMetaStore(store, blockHostedBy(store, addrs[0])); e != nil {
+		t.Errorf("%s rejects blocks after the drain was canceled: %v", addrs[0], e)
+	}
+}
+
+// A test block whose first host in the ring of store is addr
+func blockHostedBy(store *MetaStore, addr string) Block {
+	store.mtx.RLock()
+	defer store.mtx.RUnlock()
+	for i := 0; ; i++ {
+		block := testBlock(i)
+		if store.BlockStoreRing.FindBlockHosts(GetBlockHashString(block.BlockData))[0].Addr == addr {
+			return block
+		}
+	}
+}
+
+func TestRingEpochsIncreaseAcrossAbortsAndRestarts(t *testing.T) {
+	addrs, _ := startBlockStores(t, 2, 128)
+	dir := t.TempDir()
+	ring := NewConsistentHashRing(128, addrs[:1])
+	succ := false
+	if e := rpcCall(addrs[0], "BlockStore.SetRing", RingUpdate{Ring: ring, SelfAddr: addrs[0]}, &succ); e != nil {
+		t.Fatal(e)
+	}
+	store, e := NewPersistentMetaStore(ring, dir, 100)
+	if e != nil {
+		t.Fatal(e)
+	}
+	putBlocksThrough(t, &store, 60)
+
+	// the epoch of an aborted change is never handed out again
+	store.TransferOptions = TransferOptions{BatchBytes: 1, Parallelism: 1, BytesPerSecond: 200}
+	if e := store.AddNode(NodeInfo{Addr: addrs[1], Weight: 1}, &succ); e != nil {
+		t.Fatal(e)
+	}
+	if e := store.CancelMigration(0, &succ); e != nil {
+		t.Fatal(e)
+	}
+	aborted, e := store.WaitForMigration(0)
+	if e != nil || aborted.State != MigrationCanceled || aborted.Epoch <= ring.Epoch {
+		t.Fatalf("canceled change: %+v %v", aborted, e)
+	}
+	routes := BlockStoreRoutes{}
+	if e := store.GetBlockStoreRoutes(nil, &routes); e != nil || routes.Epoch != ring.Epoch {
+		t.Fatalf("routes at epoch %d (%v) after the abort, want %d", routes.Epoch, e, ring.Epoch)
+	}
+	store.Log.Close()
+
+	recovered, e := NewPersistentMetaStore(ring, dir, 100)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer recovered.Log.Close()
+	if e := recovered.AddNode(NodeInfo{Addr: addrs[1], Weight: 1}, &succ); e != nil {
+		t.Fatal(e)
+	}
+	status, e := recovered.WaitForMigration(0)
+	if e != nil || status.State != MigrationDone {
+		t.Fatalf("change after the restart: %+v %v", status, e)
+	}
+	if status.Epoch <= aborted.Epoch {
+		t.Errorf("change after the restart got epoch %d, want more than the aborted %d", status.Epoch, aborted.Epoch)
+	}
+	if e := recovered.GetBlockStoreRoutes(nil, &routes); e != nil || routes.Epoch != status.Epoch {
+		t.Errorf("routes at epoch %d (%v), want %d", routes.Epoch, e, status.Epoch)
+	}
+}
@@ -0,0 +1,236 @@
+package surfstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// States of a migration job
+const (
+	// Copying the blocks to their new hosts, the job can still be canceled
+	MigrationCopying = "copying"
+	// The new ring is committed, the old hosts drop the blocks they no longer host
+	MigrationDeleting = "deleting"
+	MigrationDone     = "done"
+	MigrationFailed   = "failed"
+	// Canceled during the copy, the ring change was undone
+	MigrationCanceled = "canceled"
+)
+
+// Number of blocks per CopyBlocks call of a migration. The job reports its
+// progress and checks for cancellation between two calls.
+const migrationChunkBlocks = 1024
+
+var ErrMigrationCanceled = fmt.Errorf("migration canceled")
+
+// Progress of a migration job
+type MigrationStatus struct {
+	Id int
+	// The ring change, e.g. "add localhost:8081"
+	Change string
+	State  string
+	// Why the job failed, set when State is MigrationFailed
+	Error string
+	// Epoch of the ring the job moves the blocks to, 0 if the change could not be started
+	Epoch int
+	// Virtual nodes of the new ring moved off their hashed index, see ConsistentHashRing.Collisions
+	Collisions      []Collision
+	BlocksMoved     int
+	BytesMoved      int
+	BlocksRemaining int
+	Started         time.Time
+	// Zero until the job is done, failed or canceled
+	Finished time.Time
+}
+
+// A ring change whose blocks move in the background
+type migrationJob struct {
+	mtx        sync.Mutex
+	status     MigrationStatus
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	done       chan struct{}
+}
+
+// Start a migration job applying change to the ring. Returns once the change is
+// logged, the blocks move in the background (see runMigration). Only one job
+// runs at a time, starting another one fails until it finishes. The BlockStores
+// in readOnly are drained: they accept no new blocks while the job runs.
+func (m *MetaStore) startRingChange(description string, change func(ring *ConsistentHashRing) error, down map[string]bool, readOnly []string) (*migrationJob, error) {
+	m.jobMtx.Lock()
+	if n := len(m.jobs); n > 0 && !m.jobs[n-1].finished() {
+		m.jobMtx.Unlock()
+		return nil, fmt.Errorf("migration %d is still running", n)
+	}
+	job := &migrationJob{
+		status: MigrationStatus{
+			Id:      len(m.jobs) + 1,
+			Change:  description,
+			State:   MigrationCopying,
+			Started: time.Now(),
+		},
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	m.jobs = append(m.jobs, job)
+	m.jobMtx.Unlock()
+
+	// membershipMtx stays locked until the job finishes
+	m.membershipMtx.Lock()
+	migration, e := m.logRingChange(change, down, readOnly)
+	if e != nil {
+		m.membershipMtx.Unlock()
+		job.finish(e)
+		return nil, e
+	}
+	job.mtx.Lock()
+	job.status.Epoch = migration.NewRing.Epoch
+	job.status.Collisions = migration.NewRing.Collisions()
+	job.mtx.Unlock()
+	go func() {
+		defer m.membershipMtx.Unlock()
+		job.finish(m.runMigration(migration, down, job))
+	}()
+	return job, nil
+}
+
+// Get the job with the given id, or the latest one if id is 0
+func (m *MetaStore) findJob(id int) (*migrationJob, error) {
+	m.jobMtx.Lock()
+	defer m.jobMtx.Unlock()
+	if id == 0 {
+		id = len(m.jobs)
+	}
+	if id < 1 || id > len(m.jobs) {
+		return nil, fmt.Errorf("no migration %d", id)
+	}
+	return m.jobs[id-1], nil
+}
+
+// Get the status of migration job id, or of the latest job if id is 0.
+// In a replicated MetaStore the jobs are run and tracked by the leader.
+func (m *MetaStore) GetMigrationStatus(id int, status *MigrationStatus) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.GetMigrationStatus", id, status); forwarded {
+		return e
+	}
+	job, e := m.findJob(id)
+	if e != nil {
+		return e
+	}
+	*status = job.snapshot()
+	return nil
+}
+
+// Cancel migration job id, or the latest job if id is 0. Only a job that is
+// still copying can be canceled; its ring change is undone in the background.
+func (m *MetaStore) CancelMigration(id int, succ *bool) error {
+	if forwarded, e := m.forwardToLeader("MetaStore.CancelMigration", id, succ); forwarded {
+		return e
+	}
+	job, e := m.findJob(id)
+	if e != nil {
+		return e
+	}
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	if job.status.State != MigrationCopying {
+		return fmt.Errorf("migration %d is %s and can no longer be canceled", job.status.Id, job.status.State)
+	}
+	job.cancelOnce.Do(func() {
+		close(job.cancel)
+	})
+	*succ = true
+	return nil
+}
+
+// Wait until migration job id, or the latest job if id is 0, finishes and get its final status
+func (m *MetaStore) WaitForMigration(id int) (MigrationStatus, error) {
+	job, e := m.findJob(id)
+	if e != nil {
+		return MigrationStatus{}, e
+	}
+	<-job.done
+	return job.snapshot(), nil
+}
+
+// The methods below accept a nil job, for migrations resumed after a crash
+
+func (job *migrationJob) snapshot() MigrationStatus {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	return job.status
+}
+
+func (job *migrationJob) finished() bool {
+	select {
+	case <-job.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (job *migrationJob) canceled() bool {
+	if job == nil {
+		return false
+	}
+	select {
+	case <-job.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Count blocks that are going to be copied
+func (job *migrationJob) addRemaining(blocks int) {
+	if job == nil {
+		return
+	}
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	job.status.BlocksRemaining += blocks
+}
+
+// Record that blocks listed blocks were handled, of which stats were actually sent
+func (job *migrationJob) addProgress(blocks int, stats TransferStats) {
+	if job == nil {
+		return
+	}
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	job.status.BlocksRemaining -= blocks
+	job.status.BlocksMoved += stats.Blocks
+	job.status.BytesMoved += stats.Bytes
+}
+
+// Move on to committing the new ring and deleting, unless the job was canceled
+func (job *migrationJob) commit() bool {
+	if job == nil {
+		return true
+	}
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	if job.canceled() {
+		return false
+	}
+	job.status.State = MigrationDeleting
+	return true
+}
+
+func (job *migrationJob) finish(e error) {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	switch {
+	case e == nil:
+		job.status.State = MigrationDone
+	case e == ErrMigrationCanceled:
+		job.status.State = MigrationCanceled
+	default:
+		job.status.State = MigrationFailed
+		job.status.Error = e.Error()
+	}
+	job.status.Finished = time.Now()
+	close(job.done)
+}
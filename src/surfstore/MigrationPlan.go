@@ -0,0 +1,246 @@
+package surfstore
+
+import (
+	"sort"
+)
+
+// A MigrationInstruction to be executed by the BlockStore at SrcAddr
+type MigrationStep struct {
+	SrcAddr string
+	Inst    MigrationInstruction
+}
+
+// A BlockTransfer to be executed by the BlockStore at SrcAddr. An empty
+// Transfer.DestAddr means the blocks are dropped from SrcAddr instead.
+type TransferStep struct {
+	SrcAddr  string
+	Transfer BlockTransfer
+}
+
+// The block movements needed to go from one ring to another.
+// All copies must finish before any of the deletes run, so that every block
+// keeps at least one copy on a node that owns it while the migration is in flight.
+type MigrationPlan struct {
+	// Copy a range to a node that owns it in the new ring but did not in the old one
+	Copies []MigrationStep
+	// Drop a range from a node that no longer owns it in the new ring
+	Deletes []MigrationStep
+	// Copy blocks that were spilled by bounded-load placement to their hosts in the new ring
+	BlockCopies []TransferStep
+	// Drop spilled blocks from nodes that no longer host them
+	BlockDeletes []TransferStep
+	// Drop every block a node does not host in the new ring and adopt its ring
+	// size, for a change of ring size (see CommitRehash)
+	Rehashes []RehashInstruction
+	// Number of ring indices and spilled blocks that could not be copied
+	// because every node holding them is down
+	Unreachable int
+}
+
+// Compute the migration from oldRing to newRing. Both rings must have the same RingSize.
+// For each ring index the replica sets of the two rings are compared: every new
+// replica receives a copy from an old replica, preferring one that stays in the
+// replica set, and every old replica that is not kept drops the index.
+func PlanMigration(oldRing *ConsistentHashRing, newRing *ConsistentHashRing) MigrationPlan {
+	return PlanMigrationAvoiding(oldRing, newRing, nil, nil)
+}
+
+// Compute the migration from oldRing to newRing without involving the nodes in
+// down: nothing is copied from or to them and nothing is deleted from them.
+// The blocks in spills, which bounded-load placement put off their natural
+// hosts in oldRing, are compared block by block in the same way.
+func PlanMigrationAvoiding(oldRing *ConsistentHashRing, newRing *ConsistentHashRing, spills map[string][]string, down map[string]bool) MigrationPlan {
+	copies := newRangeBuilder(newRing.RingSize)
+	deletes := newRangeBuilder(newRing.RingSize)
+	if len(oldRing.Nodes) == 0 {
+		// nothing is stored anywhere yet
+		return MigrationPlan{
+			Copies:       []MigrationStep{},
+			Deletes:      []MigrationStep{},
+			BlockCopies:  []TransferStep{},
+			BlockDeletes: []TransferStep{},
+		}
+	}
+
+	plan := MigrationPlan{}
+	for ringIndex := 0; ringIndex < newRing.RingSize; ringIndex++ {
+		oldAddrs := nodeAddrs(oldRing.FindHostingNodes(ringIndex))
+		newAddrs := nodeAddrs(newRing.FindHostingNodes(ringIndex))
+		oldSet := addrSet(oldAddrs)
+		newSet := addrSet(newAddrs)
+
+		srcAddr := chooseSource(oldAddrs, newSet, down)
+		for _, addr := range newAddrs {
+			if oldSet[addr] || down[addr] {
+				continue
+			}
+			if srcAddr == "" {
+				plan.Unreachable++
+				break
+			}
+			copies.add(srcAddr, addr, ringIndex)
+		}
+		for _, addr := range oldAddrs {
+			if !newSet[addr] && !down[addr] {
+				deletes.add(addr, "", ringIndex)
+			}
+		}
+	}
+
+	plan.Copies = copies.steps()
+	plan.Deletes = deletes.steps()
+	for i := range plan.Copies {
+		plan.Copies[i].Inst.KeepSource = true
+	}
+	var unreachable int
+	plan.BlockCopies, plan.BlockDeletes, unreachable = planSpillMigration(spills, newRing, down)
+	plan.Unreachable += unreachable
+	return plan
+}
+
+// Pick the node to copy from among the old replicas: one that stays in the
+// replica set if possible, never one that is down. "" if all of them are down.
+func chooseSource(oldAddrs []string, newSet map[string]bool, down map[string]bool) string {
+	srcAddr := ""
+	for _, addr := range oldAddrs {
+		if down[addr] {
+			continue
+		}
+		if newSet[addr] {
+			return addr
+		}
+		if srcAddr == "" {
+			srcAddr = addr
+		}
+	}
+	return srcAddr
+}
+
+// Compare the hosts every spilled block was placed on with its hosts in newRing
+func planSpillMigration(spills map[string][]string, newRing *ConsistentHashRing, down map[string]bool) ([]TransferStep, []TransferStep, int) {
+	unreachable := 0
+	copies := newTransferBuilder()
+	deletes := newTransferBuilder()
+
+	blockHashes := make([]string, 0, len(spills))
+	for blockHash := range spills {
+		blockHashes = append(blockHashes, blockHash)
+	}
+	sort.Strings(blockHashes)
+
+	for _, blockHash := range blockHashes {
+		oldAddrs := spills[blockHash]
+		newAddrs := nodeAddrs(newRing.FindBlockHosts(blockHash))
+		oldSet := addrSet(oldAddrs)
+		newSet := addrSet(newAddrs)
+
+		srcAddr := chooseSource(oldAddrs, newSet, down)
+		for _, addr := range newAddrs {
+			if oldSet[addr] || down[addr] {
+				continue
+			}
+			if srcAddr == "" {
+				unreachable++
+				break
+			}
+			copies.add(srcAddr, addr, blockHash)
+		}
+		for _, addr := range oldAddrs {
+			if !newSet[addr] && !down[addr] {
+				deletes.add(addr, "", blockHash)
+			}
+		}
+	}
+	return copies.steps, deletes.steps, unreachable
+}
+
+// Groups block hashes per (source, destination) pair
+type transferBuilder struct {
+	steps    []TransferStep
+	position map[[2]string]int
+}
+
+func newTransferBuilder() *transferBuilder {
+	return &transferBuilder{
+		steps:    make([]TransferStep, 0),
+		position: make(map[[2]string]int),
+	}
+}
+
+func (tb *transferBuilder) add(srcAddr string, destAddr string, blockHash string) {
+	key := [2]string{srcAddr, destAddr}
+	pos, ok := tb.position[key]
+	if !ok {
+		pos = len(tb.steps)
+		tb.position[key] = pos
+		tb.steps = append(tb.steps, TransferStep{SrcAddr: srcAddr, Transfer: BlockTransfer{BlockHashes: []string{}, DestAddr: destAddr}})
+	}
+	tb.steps[pos].Transfer.BlockHashes = append(tb.steps[pos].Transfer.BlockHashes, blockHash)
+}
+
+func nodeAddrs(nodes []Node) []string {
+	addrs := make([]string, len(nodes))
+	for i, node := range nodes {
+		addrs[i] = node.Addr
+	}
+	return addrs
+}
+
+func addrSet(addrs []string) map[string]bool {
+	set := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		set[addr] = true
+	}
+	return set
+}
+
+// Collects ring indices per (source, destination) pair and merges
+// consecutive indices into MigrationInstruction ranges
+type rangeBuilder struct {
+	ringSize int
+	keys     []MigrationStep
+	ranges   map[MigrationStep][]MigrationInstruction
+}
+
+func newRangeBuilder(ringSize int) *rangeBuilder {
+	return &rangeBuilder{
+		ringSize: ringSize,
+		keys:     make([]MigrationStep, 0),
+		ranges:   make(map[MigrationStep][]MigrationInstruction),
+	}
+}
+
+// Record that ringIndex moves from srcAddr to destAddr. Indices must be added in increasing order.
+func (rb *rangeBuilder) add(srcAddr string, destAddr string, ringIndex int) {
+	key := MigrationStep{SrcAddr: srcAddr, Inst: MigrationInstruction{DestAddr: destAddr}}
+	ranges, ok := rb.ranges[key]
+	if !ok {
+		rb.keys = append(rb.keys, key)
+	}
+	if len(ranges) > 0 && ranges[len(ranges)-1].UpperIndex == ringIndex-1 {
+		ranges[len(ranges)-1].UpperIndex = ringIndex
+	} else {
+		ranges = append(ranges, MigrationInstruction{LowerIndex: ringIndex, UpperIndex: ringIndex, DestAddr: destAddr})
+	}
+	rb.ranges[key] = ranges
+}
+
+// Build the steps, joining a range ending at the top of the ring with one starting at 0
+func (rb *rangeBuilder) steps() []MigrationStep {
+	steps := make([]MigrationStep, 0)
+	for _, key := range rb.keys {
+		ranges := rb.ranges[key]
+		last := len(ranges) - 1
+		if last > 0 && ranges[0].LowerIndex == 0 && ranges[last].UpperIndex == rb.ringSize-1 {
+			ranges[0].LowerIndex = ranges[last].LowerIndex
+			ranges = ranges[:last]
+		}
+		for _, inst := range ranges {
+			steps = append(steps, MigrationStep{SrcAddr: key.SrcAddr, Inst: inst})
+		}
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].SrcAddr < steps[j].SrcAddr
+	})
+	return steps
+}
@@ -0,0 +1,255 @@
+package surfstore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Names of the placement strategies a ConsistentHashRing can use
+const (
+	PlacementRing       = "ring"
+	PlacementRendezvous = "rendezvous"
+	PlacementJump       = "jump"
+	PlacementMaglev     = "maglev"
+)
+
+// PlacementStrategy decides which BlockStores host a ring index.
+// Blocks are always mapped to a ring index first (ComputeBlockIndex), so every
+// strategy hands out whole ring indices and PlanMigration can compute the
+// migration ranges between any two rings by comparing their replica sets.
+type PlacementStrategy interface {
+	// Precompute the lookup state of the strategy from the ring members into ring.Lookup
+	Build(ring *ConsistentHashRing)
+
+	// Find up to replicas nodes with distinct addresses hosting ringIndex, primary first
+	Locate(ring *ConsistentHashRing, ringIndex int, replicas int) []Node
+}
+
+var placementStrategies = map[string]PlacementStrategy{
+	PlacementRing:       consistentHashPlacement{},
+	PlacementRendezvous: rendezvousPlacement{},
+	PlacementJump:       jumpPlacement{},
+	PlacementMaglev:     maglevPlacement{},
+}
+
+// Look up a placement strategy by name, "" is the classic consistent hash ring
+func GetPlacementStrategy(name string) (PlacementStrategy, error) {
+	if name == "" {
+		name = PlacementRing
+	}
+	strategy, ok := placementStrategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown placement strategy %q", name)
+	}
+	return strategy, nil
+}
+
+// The classic ring: the hosting node is the first node clockwise from the ring
+// index, the replicas are the next nodes clockwise with distinct addresses.
+type consistentHashPlacement struct{}
+
+func (consistentHashPlacement) Build(ring *ConsistentHashRing) {
+	ring.Lookup = nil
+}
+
+func (consistentHashPlacement) Locate(ring *ConsistentHashRing, ringIndex int, replicas int) []Node {
+	hosts := make([]Node, 0, replicas)
+	if len(ring.Nodes) == 0 {
+		return hosts
+	}
+	seen := make(map[string]bool)
+	start := ring.successorPosition(ringIndex)
+	for i := 0; i < len(ring.Nodes) && len(hosts) < replicas; i++ {
+		node := ring.Nodes[(start+i)%len(ring.Nodes)]
+		if seen[node.Addr] {
+			continue
+		}
+		seen[node.Addr] = true
+		hosts = append(hosts, node)
+	}
+	return hosts
+}
+
+// Rendezvous (highest random weight) hashing: every member scores each ring
+// index and the highest scores win. A membership change only moves the indices
+// the changed member wins or loses. Weights use the logarithmic method, so a
+// member of weight w wins w times as often as one of weight 1.
+type rendezvousPlacement struct{}
+
+func (rendezvousPlacement) Build(ring *ConsistentHashRing) {
+	ring.Lookup = nil
+}
+
+func (rendezvousPlacement) Locate(ring *ConsistentHashRing, ringIndex int, replicas int) []Node {
+	type score struct {
+		addr  string
+		value float64
+	}
+	scores := make([]score, 0)
+	for addr, weight := range ring.members() {
+		// uniform in (0, 1)
+		u := (float64(placementHash(addr, strconv.Itoa(ringIndex))>>11) + 0.5) / (1 << 53)
+		scores = append(scores, score{addr: addr, value: float64(weight) / -math.Log(u)})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].value != scores[j].value {
+			return scores[i].value > scores[j].value
+		}
+		return scores[i].addr < scores[j].addr
+	})
+
+	hosts := make([]Node, 0, replicas)
+	for i := 0; i < len(scores) && len(hosts) < replicas; i++ {
+		hosts = append(hosts, ring.firstNode(scores[i].addr))
+	}
+	return hosts
+}
+
+// Jump consistent hash over a bucket list in which every member appears once per
+// unit of weight, members sorted by address. Jump hash moves the minimum number
+// of ring indices when buckets are added or removed at the end of the list;
+// a member joining or leaving in the middle of the list moves more of them.
+// Replicas are the next buckets with distinct addresses.
+type jumpPlacement struct{}
+
+func (jumpPlacement) Build(ring *ConsistentHashRing) {
+	members := ring.members()
+	buckets := make([]string, 0)
+	for _, addr := range ring.Addrs() {
+		for i := 0; i < members[addr]; i++ {
+			buckets = append(buckets, addr)
+		}
+	}
+	ring.Lookup = buckets
+}
+
+func (jumpPlacement) Locate(ring *ConsistentHashRing, ringIndex int, replicas int) []Node {
+	if len(ring.Lookup) == 0 {
+		return make([]Node, 0)
+	}
+	start := jumpHash(placementHash(strconv.Itoa(ringIndex)), len(ring.Lookup))
+	return ring.distinctLookupNodes(start, replicas)
+}
+
+// Lamping and Veach, "A Fast, Minimal Memory, Consistent Hash Algorithm"
+func jumpHash(key uint64, numBuckets int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Maglev hashing: a lookup table whose size is the smallest prime >= RingSize is
+// filled by letting every member claim slots along its own permutation of the
+// table in turns, weight slots per turn. Ring index i is hosted by the member
+// in slot i, the replicas by the next slots with distinct addresses.
+type maglevPlacement struct{}
+
+func (maglevPlacement) Build(ring *ConsistentHashRing) {
+	tableSize := nextPrime(ring.RingSize)
+	table := make([]string, tableSize)
+	addrs := ring.Addrs()
+	if len(addrs) == 0 {
+		ring.Lookup = nil
+		return
+	}
+	members := ring.members()
+
+	offsets := make([]int, len(addrs))
+	skips := make([]int, len(addrs))
+	next := make([]int, len(addrs))
+	for i, addr := range addrs {
+		offsets[i] = int(placementHash(addr, "offset") % uint64(tableSize))
+		skips[i] = 1
+		if tableSize > 1 {
+			skips[i] = int(placementHash(addr, "skip")%uint64(tableSize-1)) + 1
+		}
+	}
+
+	filled := 0
+	for filled < tableSize {
+		for i, addr := range addrs {
+			for turn := 0; turn < members[addr] && filled < tableSize; turn++ {
+				slot := (offsets[i] + next[i]*skips[i]) % tableSize
+				for table[slot] != "" {
+					next[i]++
+					slot = (offsets[i] + next[i]*skips[i]) % tableSize
+				}
+				table[slot] = addr
+				next[i]++
+				filled++
+			}
+		}
+	}
+	ring.Lookup = table
+}
+
+func (maglevPlacement) Locate(ring *ConsistentHashRing, ringIndex int, replicas int) []Node {
+	if len(ring.Lookup) == 0 {
+		return make([]Node, 0)
+	}
+	return ring.distinctLookupNodes(ringIndex%len(ring.Lookup), replicas)
+}
+
+// Walk ring.Lookup from start and collect up to replicas distinct addresses
+func (ms *ConsistentHashRing) distinctLookupNodes(start int, replicas int) []Node {
+	hosts := make([]Node, 0, replicas)
+	seen := make(map[string]bool)
+	for i := 0; i < len(ms.Lookup) && len(hosts) < replicas; i++ {
+		addr := ms.Lookup[(start+i)%len(ms.Lookup)]
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		hosts = append(hosts, ms.firstNode(addr))
+	}
+	return hosts
+}
+
+// Get the node of addr with the lowest token, used to represent the address
+// by strategies that do not place virtual nodes
+func (ms *ConsistentHashRing) firstNode(addr string) Node {
+	first := Node{Addr: addr, Index: -1, Token: -1}
+	for _, node := range ms.Nodes {
+		if node.Addr == addr && (first.Token < 0 || node.Token < first.Token) {
+			first = node
+		}
+	}
+	return first
+}
+
+// Hash strings to a 64 bit integer
+func placementHash(parts ...string) uint64 {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8])
+}
+
+// Smallest prime >= n, at least 2
+func nextPrime(n int) int {
+	if n < 2 {
+		return 2
+	}
+	for ; ; n++ {
+		prime := true
+		for d := 2; d*d <= n; d++ {
+			if n%d == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			return n
+		}
+	}
+}
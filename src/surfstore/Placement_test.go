@@ -0,0 +1,108 @@
+package surfstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+var placementTests = []struct {
+	placement string
+	// a joining node only takes ring indices, the others never swap theirs
+	onlyToJoined bool
+}{
+	{PlacementRing, true},
+	{PlacementRendezvous, true},
+	{PlacementJump, true},
+	{PlacementMaglev, false},
+}
+
+func placementRing(t *testing.T, placement string, addrs []string) ConsistentHashRing {
+	t.Helper()
+	ring, e := NewVirtualConsistentHashRing(1024, 16, addrs)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ring.Replicas = 2
+	if e := ring.SetPlacement(placement); e != nil {
+		t.Fatal(e)
+	}
+	return ring
+}
+
+func TestPlacementReplicaSets(t *testing.T) {
+	for _, test := range placementTests {
+		t.Run(test.placement, func(t *testing.T) {
+			addrs := testAddrs(4)
+			ring := placementRing(t, test.placement, addrs)
+			reordered := placementRing(t, test.placement, []string{addrs[2], addrs[0], addrs[3], addrs[1]})
+			if e := ring.Validate(); e != nil {
+				t.Fatal(e)
+			}
+
+			owned := make(map[string]int)
+			for ringIndex := 0; ringIndex < ring.RingSize; ringIndex++ {
+				hosts := nodeAddrs(ring.FindHostingNodes(ringIndex))
+				if len(hosts) != 2 || hosts[0] == hosts[1] {
+					t.Fatalf("ring index %d is hosted by %v, want 2 distinct BlockStores", ringIndex, hosts)
+				}
+				if other := nodeAddrs(reordered.FindHostingNodes(ringIndex)); !reflect.DeepEqual(hosts, other) {
+					t.Fatalf("ring index %d is hosted by %v or %v depending on the join order", ringIndex, hosts, other)
+				}
+				owned[hosts[0]]++
+			}
+			// every member is the primary of a fair share of the ring, give or take half
+			for _, addr := range addrs {
+				if share := owned[addr]; share < ring.RingSize/8 || share > ring.RingSize*3/8 {
+					t.Errorf("%s hosts %d of %d ring indices", addr, share, ring.RingSize)
+				}
+			}
+		})
+	}
+}
+
+func TestPlacementMovesFewIndicesOnJoin(t *testing.T) {
+	for _, test := range placementTests {
+		t.Run(test.placement, func(t *testing.T) {
+			addrs := testAddrs(5)
+			before := placementRing(t, test.placement, addrs[:4])
+			after := before.Copy()
+			// the joining address sorts last, which jump hash needs to move the minimum
+			if e := after.AddNode(addrs[4]); e != nil {
+				t.Fatal(e)
+			}
+
+			moved := 0
+			for ringIndex := 0; ringIndex < before.RingSize; ringIndex++ {
+				oldHost := before.FindHostingNode(ringIndex).Addr
+				newHost := after.FindHostingNode(ringIndex).Addr
+				if oldHost == newHost {
+					continue
+				}
+				moved++
+				if test.onlyToJoined && newHost != addrs[4] {
+					t.Errorf("ring index %d moved from %s to %s, not to the joining %s", ringIndex, oldHost, newHost, addrs[4])
+				}
+			}
+			// the joining node deserves a fifth of the ring
+			if ideal := before.RingSize / 5; moved > 2*ideal {
+				t.Errorf("%d ring indices moved, want at most %d", moved, 2*ideal)
+			}
+			if moved == 0 {
+				t.Error("the joining node hosts nothing")
+			}
+		})
+	}
+}
+
+func TestValidateRejectsUnknownPlacement(t *testing.T) {
+	ring := NewConsistentHashRing(128, testAddrs(2))
+	ring.Placement = "random"
+	if e := ring.Validate(); e == nil {
+		t.Fatal("ring with an unknown placement strategy is valid")
+	}
+	ring.Placement = PlacementMaglev
+	ring.Lookup = []string{"localhost:9999"}
+	if e := ring.Validate(); e == nil {
+		t.Fatal("ring with a lookup entry outside the ring is valid")
+	}
+}
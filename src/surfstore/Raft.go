@@ -0,0 +1,683 @@
+package surfstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Raft consensus (Ongaro and Ousterhout, "In Search of an Understandable
+// Consensus Algorithm") for a replicated MetaStore. Every state change is a
+// MetaLogEntry committed through the Raft log and applied in log order on every
+// replica. Replicas talk to each other through the "Raft" RPC service, which is
+// registered on the same server as their MetaStore.
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+const (
+	raftTickInterval      = 10 * time.Millisecond
+	raftHeartbeatInterval = 50 * time.Millisecond
+	// Election timeouts are drawn from [raftElectionTimeout, 2*raftElectionTimeout)
+	raftElectionTimeout = 300 * time.Millisecond
+	raftRPCTimeout      = 500 * time.Millisecond
+	raftSubmitTimeout   = 5 * time.Second
+	// Maximum number of entries sent in one AppendEntries call
+	raftMaxBatch = 256
+
+	raftStateFileName = "raft.state"
+	raftLogFileName   = "raft.wal"
+)
+
+var ErrNotLeader = fmt.Errorf("this MetaStore replica is not the Raft leader")
+var ErrNoLeader = fmt.Errorf("no Raft leader is known, retry later")
+var ErrRaftStopped = fmt.Errorf("this MetaStore replica is stopped")
+
+// A MetaStore state change in the Raft log
+type RaftEntry struct {
+	Index   int
+	Term    int
+	Command MetaLogEntry
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	CandidateId  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderId     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []RaftEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+	// On failure, the index the leader should retry from
+	ConflictIndex int
+}
+
+// Term and vote, persisted before they are acted upon
+type raftHardState struct {
+	CurrentTerm int
+	VotedFor    int
+}
+
+// Waits for the entry a Submit appended at some index to be applied
+type raftWaiter struct {
+	term   int
+	result chan error
+}
+
+// RaftNode is one replica of the Raft group. Peers holds the addresses of all
+// replicas, this one being Peers[Id]. The term, vote and log are persisted in
+// Dir (nothing is persisted when Dir is empty). The log is never compacted.
+type RaftNode struct {
+	Peers []string
+	Id    int
+	Dir   string
+
+	mtx             sync.Mutex
+	state           int
+	currentTerm     int
+	votedFor        int
+	log             []RaftEntry // log[0] is a sentinel, entries start at index 1
+	commitIndex     int
+	lastApplied     int
+	leaderId        int
+	nextIndex       []int
+	matchIndex      []int
+	lastHeard       time.Time
+	lastBroadcast   time.Time
+	electionTimeout time.Duration
+	random          *rand.Rand
+	waiters         map[int]raftWaiter
+	applyCond       *sync.Cond
+	apply           func(entry MetaLogEntry) error
+	onLeader        func()
+	wal             *os.File
+	stopped         bool
+	done            chan struct{}
+
+	connMtx sync.Mutex
+	conns   map[int]*rpc.Client
+}
+
+// Recover the Raft state from dir and start taking part in elections.
+// apply is called with every committed command, in log order, and its result
+// is returned by the Submit call that proposed the command. onLeader, unless
+// nil, is called in the background every time this replica becomes the leader.
+func StartRaftNode(peers []string, id int, dir string, apply func(entry MetaLogEntry) error, onLeader func()) (*RaftNode, error) {
+	if id < 0 || id >= len(peers) {
+		return nil, fmt.Errorf("replica id %d out of range for %d peers", id, len(peers))
+	}
+	rn := &RaftNode{
+		Peers:    peers,
+		Id:       id,
+		Dir:      dir,
+		votedFor: -1,
+		log:      []RaftEntry{{}},
+		leaderId: -1,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano() + int64(id))),
+		waiters:  make(map[int]raftWaiter),
+		apply:    apply,
+		onLeader: onLeader,
+		done:     make(chan struct{}),
+		conns:    make(map[int]*rpc.Client),
+	}
+	rn.applyCond = sync.NewCond(&rn.mtx)
+	if dir != "" {
+		if e := rn.recover(); e != nil {
+			return nil, e
+		}
+	}
+	rn.resetElectionTimerLocked()
+
+	go rn.run()
+	go rn.applyLoop()
+	return rn, nil
+}
+
+// Report whether this replica is the leader, and else the address of the leader if one is known
+func (rn *RaftNode) Leader() (bool, string) {
+	rn.mtx.Lock()
+	defer rn.mtx.Unlock()
+	if rn.state == raftLeader {
+		return true, rn.Peers[rn.Id]
+	}
+	if rn.leaderId < 0 {
+		return false, ""
+	}
+	return false, rn.Peers[rn.leaderId]
+}
+
+// Propose a command and wait until it is committed and applied on this replica.
+// Only the leader accepts commands.
+func (rn *RaftNode) Submit(command MetaLogEntry) error {
+	rn.mtx.Lock()
+	if rn.stopped {
+		rn.mtx.Unlock()
+		return ErrRaftStopped
+	}
+	if rn.state != raftLeader {
+		rn.mtx.Unlock()
+		return ErrNotLeader
+	}
+	entry := RaftEntry{Index: rn.lastIndex() + 1, Term: rn.currentTerm, Command: command}
+	if e := rn.appendLocked(entry); e != nil {
+		rn.mtx.Unlock()
+		return e
+	}
+	waiter := raftWaiter{term: entry.Term, result: make(chan error, 1)}
+	rn.waiters[entry.Index] = waiter
+	rn.advanceCommitLocked()
+	rn.broadcastLocked()
+	rn.mtx.Unlock()
+
+	select {
+	case e := <-waiter.result:
+		return e
+	case <-rn.done:
+		return ErrRaftStopped
+	case <-time.After(raftSubmitTimeout):
+		rn.mtx.Lock()
+		delete(rn.waiters, entry.Index)
+		rn.mtx.Unlock()
+		return fmt.Errorf("timed out waiting for Raft entry %d to commit", entry.Index)
+	}
+}
+
+// Stop the replica as if its process died. Persisted state is kept, so a new
+// RaftNode started on the same Dir continues where this one left off.
+func (rn *RaftNode) Stop() {
+	rn.mtx.Lock()
+	if rn.stopped {
+		rn.mtx.Unlock()
+		return
+	}
+	rn.stopped = true
+	close(rn.done)
+	rn.applyCond.Broadcast()
+	if rn.wal != nil {
+		rn.wal.Close()
+		rn.wal = nil
+	}
+	rn.mtx.Unlock()
+
+	rn.connMtx.Lock()
+	for peer, conn := range rn.conns {
+		conn.Close()
+		delete(rn.conns, peer)
+	}
+	rn.connMtx.Unlock()
+}
+
+// RequestVote RPC, sent by candidates
+func (rn *RaftNode) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	rn.mtx.Lock()
+	defer rn.mtx.Unlock()
+	if rn.stopped {
+		return ErrRaftStopped
+	}
+	if args.Term > rn.currentTerm {
+		if e := rn.stepDownLocked(args.Term); e != nil {
+			return e
+		}
+	}
+	reply.Term = rn.currentTerm
+	if args.Term < rn.currentTerm {
+		return nil
+	}
+
+	lastTerm := rn.log[rn.lastIndex()].Term
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= rn.lastIndex())
+	if (rn.votedFor < 0 || rn.votedFor == args.CandidateId) && upToDate {
+		rn.votedFor = args.CandidateId
+		if e := rn.persistStateLocked(); e != nil {
+			return e
+		}
+		reply.VoteGranted = true
+		rn.lastHeard = time.Now()
+	}
+	return nil
+}
+
+// AppendEntries RPC, sent by the leader to replicate its log and as heartbeat
+func (rn *RaftNode) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	rn.mtx.Lock()
+	defer rn.mtx.Unlock()
+	if rn.stopped {
+		return ErrRaftStopped
+	}
+	reply.Term = rn.currentTerm
+	if args.Term < rn.currentTerm {
+		return nil
+	}
+	if args.Term > rn.currentTerm || rn.state != raftFollower {
+		if e := rn.stepDownLocked(args.Term); e != nil {
+			return e
+		}
+	}
+	reply.Term = rn.currentTerm
+	rn.leaderId = args.LeaderId
+	rn.lastHeard = time.Now()
+
+	if args.PrevLogIndex > rn.lastIndex() {
+		reply.ConflictIndex = rn.lastIndex() + 1
+		return nil
+	}
+	if term := rn.log[args.PrevLogIndex].Term; term != args.PrevLogTerm {
+		// skip back over the whole conflicting term
+		i := args.PrevLogIndex
+		for i > 1 && rn.log[i-1].Term == term {
+			i--
+		}
+		reply.ConflictIndex = i
+		return nil
+	}
+
+	for i, entry := range args.Entries {
+		if entry.Index <= rn.lastIndex() {
+			if rn.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			// conflicting suffix, never committed
+			rn.log = rn.log[:entry.Index]
+		}
+		if e := rn.appendLocked(args.Entries[i:]...); e != nil {
+			return e
+		}
+		break
+	}
+
+	if args.LeaderCommit > rn.commitIndex {
+		lastNew := args.PrevLogIndex + len(args.Entries)
+		rn.commitIndex = args.LeaderCommit
+		if lastNew < rn.commitIndex {
+			rn.commitIndex = lastNew
+		}
+		rn.applyCond.Broadcast()
+	}
+	reply.Success = true
+	return nil
+}
+
+// Drive elections and heartbeats until the node is stopped
+func (rn *RaftNode) run() {
+	ticker := time.NewTicker(raftTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rn.done:
+			return
+		case <-ticker.C:
+		}
+		rn.mtx.Lock()
+		if rn.state == raftLeader {
+			if time.Since(rn.lastBroadcast) >= raftHeartbeatInterval {
+				rn.broadcastLocked()
+			}
+		} else if time.Since(rn.lastHeard) >= rn.electionTimeout {
+			rn.startElectionLocked()
+		}
+		rn.mtx.Unlock()
+	}
+}
+
+// Apply committed entries in order and hand the results to waiting Submit calls
+func (rn *RaftNode) applyLoop() {
+	rn.mtx.Lock()
+	defer rn.mtx.Unlock()
+	for {
+		for !rn.stopped && rn.lastApplied >= rn.commitIndex {
+			rn.applyCond.Wait()
+		}
+		if rn.stopped {
+			return
+		}
+		entries := make([]RaftEntry, rn.commitIndex-rn.lastApplied)
+		copy(entries, rn.log[rn.lastApplied+1:rn.commitIndex+1])
+		rn.mtx.Unlock()
+
+		for _, entry := range entries {
+			result := rn.apply(entry.Command)
+			rn.mtx.Lock()
+			rn.lastApplied = entry.Index
+			if waiter, ok := rn.waiters[entry.Index]; ok {
+				delete(rn.waiters, entry.Index)
+				if waiter.term != entry.Term {
+					// the proposed entry was overwritten by another leader
+					result = fmt.Errorf("lost Raft leadership before entry %d committed", entry.Index)
+				}
+				waiter.result <- result
+			}
+			rn.mtx.Unlock()
+		}
+		rn.mtx.Lock()
+	}
+}
+
+// Become a candidate for the next term and ask every peer for its vote. Caller holds rn.mtx.
+func (rn *RaftNode) startElectionLocked() {
+	rn.state = raftCandidate
+	rn.currentTerm++
+	rn.votedFor = rn.Id
+	rn.leaderId = -1
+	rn.resetElectionTimerLocked()
+	if e := rn.persistStateLocked(); e != nil {
+		return
+	}
+
+	args := RequestVoteArgs{
+		Term:         rn.currentTerm,
+		CandidateId:  rn.Id,
+		LastLogIndex: rn.lastIndex(),
+		LastLogTerm:  rn.log[rn.lastIndex()].Term,
+	}
+	votes := 1
+	if votes > len(rn.Peers)/2 {
+		rn.becomeLeaderLocked()
+		return
+	}
+	for peer := range rn.Peers {
+		if peer == rn.Id {
+			continue
+		}
+		go func(peer int) {
+			var reply RequestVoteReply
+			if e := rn.call(peer, "Raft.RequestVote", args, &reply); e != nil {
+				return
+			}
+			rn.mtx.Lock()
+			defer rn.mtx.Unlock()
+			if reply.Term > rn.currentTerm {
+				rn.stepDownLocked(reply.Term)
+				return
+			}
+			if rn.stopped || rn.state != raftCandidate || rn.currentTerm != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes > len(rn.Peers)/2 {
+				rn.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+// Take over as leader. A no-op entry of the new term commits the entries of
+// earlier terms. Caller holds rn.mtx.
+func (rn *RaftNode) becomeLeaderLocked() {
+	rn.state = raftLeader
+	rn.leaderId = rn.Id
+	rn.nextIndex = make([]int, len(rn.Peers))
+	rn.matchIndex = make([]int, len(rn.Peers))
+	for peer := range rn.Peers {
+		rn.nextIndex[peer] = rn.lastIndex() + 1
+	}
+	if e := rn.appendLocked(RaftEntry{Index: rn.lastIndex() + 1, Term: rn.currentTerm, Command: MetaLogEntry{Type: LogNoop}}); e != nil {
+		rn.stepDownLocked(rn.currentTerm)
+		return
+	}
+	rn.advanceCommitLocked()
+	rn.broadcastLocked()
+	if rn.onLeader != nil {
+		go rn.onLeader()
+	}
+}
+
+// Return to follower, adopting term if it is newer. Caller holds rn.mtx.
+func (rn *RaftNode) stepDownLocked(term int) error {
+	rn.state = raftFollower
+	if term > rn.currentTerm {
+		rn.currentTerm = term
+		rn.votedFor = -1
+		rn.leaderId = -1
+		return rn.persistStateLocked()
+	}
+	return nil
+}
+
+// Send AppendEntries to every peer. Caller holds rn.mtx.
+func (rn *RaftNode) broadcastLocked() {
+	rn.lastBroadcast = time.Now()
+	for peer := range rn.Peers {
+		if peer != rn.Id {
+			go rn.replicateTo(peer, rn.currentTerm)
+		}
+	}
+}
+
+// Send the entries peer is missing, or a heartbeat if it has them all
+func (rn *RaftNode) replicateTo(peer int, term int) {
+	rn.mtx.Lock()
+	if rn.stopped || rn.state != raftLeader || rn.currentTerm != term {
+		rn.mtx.Unlock()
+		return
+	}
+	prevIndex := rn.nextIndex[peer] - 1
+	end := rn.lastIndex() + 1
+	if end-prevIndex-1 > raftMaxBatch {
+		end = prevIndex + 1 + raftMaxBatch
+	}
+	entries := make([]RaftEntry, end-prevIndex-1)
+	copy(entries, rn.log[prevIndex+1:end])
+	args := AppendEntriesArgs{
+		Term:         term,
+		LeaderId:     rn.Id,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  rn.log[prevIndex].Term,
+		Entries:      entries,
+		LeaderCommit: rn.commitIndex,
+	}
+	rn.mtx.Unlock()
+
+	var reply AppendEntriesReply
+	if e := rn.call(peer, "Raft.AppendEntries", args, &reply); e != nil {
+		return
+	}
+
+	rn.mtx.Lock()
+	defer rn.mtx.Unlock()
+	if reply.Term > rn.currentTerm {
+		rn.stepDownLocked(reply.Term)
+		return
+	}
+	if rn.stopped || rn.state != raftLeader || rn.currentTerm != term {
+		return
+	}
+	if !reply.Success {
+		if reply.ConflictIndex >= 1 && reply.ConflictIndex <= rn.lastIndex()+1 {
+			rn.nextIndex[peer] = reply.ConflictIndex
+		} else if rn.nextIndex[peer] > 1 {
+			rn.nextIndex[peer]--
+		}
+		go rn.replicateTo(peer, term)
+		return
+	}
+	match := prevIndex + len(entries)
+	if match > rn.matchIndex[peer] {
+		rn.matchIndex[peer] = match
+	}
+	rn.nextIndex[peer] = match + 1
+	rn.advanceCommitLocked()
+	if match < rn.lastIndex() {
+		go rn.replicateTo(peer, term)
+	}
+}
+
+// Commit the latest entry of the current term stored on a majority. Caller holds rn.mtx.
+func (rn *RaftNode) advanceCommitLocked() {
+	for n := rn.lastIndex(); n > rn.commitIndex && rn.log[n].Term == rn.currentTerm; n-- {
+		count := 1
+		for peer := range rn.Peers {
+			if peer != rn.Id && rn.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count > len(rn.Peers)/2 {
+			rn.commitIndex = n
+			rn.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (rn *RaftNode) lastIndex() int {
+	return len(rn.log) - 1
+}
+
+func (rn *RaftNode) resetElectionTimerLocked() {
+	rn.lastHeard = time.Now()
+	rn.electionTimeout = raftElectionTimeout + time.Duration(rn.random.Int63n(int64(raftElectionTimeout)))
+}
+
+// Call a peer over a cached connection, dropping the connection on failure
+func (rn *RaftNode) call(peer int, serviceMethod string, args interface{}, reply interface{}) error {
+	rn.connMtx.Lock()
+	conn, ok := rn.conns[peer]
+	rn.connMtx.Unlock()
+	if !ok {
+		var e error
+		conn, e = rpc.DialHTTP("tcp", rn.Peers[peer])
+		if e != nil {
+			return e
+		}
+		rn.connMtx.Lock()
+		if cached, ok := rn.conns[peer]; ok {
+			conn.Close()
+			conn = cached
+		} else {
+			rn.conns[peer] = conn
+		}
+		rn.connMtx.Unlock()
+	}
+
+	var e error
+	select {
+	case call := <-conn.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1)).Done:
+		e = call.Error
+	case <-time.After(raftRPCTimeout):
+		e = fmt.Errorf("%s to %s timed out", serviceMethod, rn.Peers[peer])
+	}
+	if e == rpc.ErrShutdown || e == io.ErrUnexpectedEOF {
+		rn.connMtx.Lock()
+		if rn.conns[peer] == conn {
+			delete(rn.conns, peer)
+		}
+		rn.connMtx.Unlock()
+		conn.Close()
+	}
+	return e
+}
+
+// Append entries to the log, durably when the node has a Dir. Caller holds rn.mtx.
+func (rn *RaftNode) appendLocked(entries ...RaftEntry) error {
+	if rn.wal != nil {
+		for i := range entries {
+			var payload bytes.Buffer
+			if e := gob.NewEncoder(&payload).Encode(&entries[i]); e != nil {
+				return e
+			}
+			if e := writeRecord(rn.wal, payload.Bytes()); e != nil {
+				return e
+			}
+		}
+		if e := rn.wal.Sync(); e != nil {
+			return e
+		}
+	}
+	rn.log = append(rn.log, entries...)
+	if rn.state == raftLeader {
+		rn.matchIndex[rn.Id] = rn.lastIndex()
+	}
+	return nil
+}
+
+// Persist the current term and vote. Caller holds rn.mtx.
+func (rn *RaftNode) persistStateLocked() error {
+	if rn.Dir == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if e := gob.NewEncoder(&buf).Encode(raftHardState{CurrentTerm: rn.currentTerm, VotedFor: rn.votedFor}); e != nil {
+		return e
+	}
+	return writeFileAtomic(filepath.Join(rn.Dir, raftStateFileName), buf.Bytes())
+}
+
+// Load the term, vote and log from Dir and open the log for appending.
+// Entries are appended to the log file as they arrive, so an entry that
+// overwrites a conflicting one simply follows it in the file: on recovery every
+// entry truncates the log to its index before it is appended.
+func (rn *RaftNode) recover() error {
+	if e := os.MkdirAll(rn.Dir, 0755); e != nil {
+		return e
+	}
+	data, e := ioutil.ReadFile(filepath.Join(rn.Dir, raftStateFileName))
+	if e == nil {
+		var hard raftHardState
+		if e := gob.NewDecoder(bytes.NewReader(data)).Decode(&hard); e != nil {
+			return fmt.Errorf("corrupt Raft state: %v", e)
+		}
+		rn.currentTerm = hard.CurrentTerm
+		rn.votedFor = hard.VotedFor
+	} else if !os.IsNotExist(e) {
+		return e
+	}
+
+	f, e := os.OpenFile(filepath.Join(rn.Dir, raftLogFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if e != nil {
+		return e
+	}
+	reader := bufio.NewReader(f)
+	validSize := int64(0)
+	for {
+		payload, n, e := readRecord(reader)
+		if e != nil {
+			break
+		}
+		var entry RaftEntry
+		if e := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry); e != nil {
+			break
+		}
+		if entry.Index < 1 || entry.Index > len(rn.log) {
+			break
+		}
+		validSize += int64(n)
+		rn.log = append(rn.log[:entry.Index], entry)
+	}
+	if e := f.Truncate(validSize); e != nil {
+		f.Close()
+		return e
+	}
+	if _, e := f.Seek(validSize, io.SeekStart); e != nil {
+		f.Close()
+		return e
+	}
+	rn.wal = f
+	return nil
+}
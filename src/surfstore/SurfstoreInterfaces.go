@@ -5,10 +5,128 @@ type Block struct {
 	BlockSize int
 }
 
+// How a BlockStore sends blocks to another one. The zero value sends batches of
+// DefaultTransferBatchBytes over one connection without a bandwidth limit.
+type TransferOptions struct {
+	// Approximate number of block bytes sent per ReplicateBlocks call
+	BatchBytes int
+	// Number of batches in flight at once
+	Parallelism int
+	// Upper bound on the bytes sent per second, 0 is unlimited
+	BytesPerSecond int
+}
+
 type MigrationInstruction struct {
 	LowerIndex int
 	UpperIndex int
 	DestAddr   string
+	// Copy the blocks instead of moving them, the source keeps its copies
+	KeepSource bool
+}
+
+// A ring sent to a BlockStore, along with the address of that BlockStore in the
+// ring. SelfAddr is empty when the ring is passed on by gossip. A Pending ring is
+// the target of a migration in progress and is not committed yet.
+type RingUpdate struct {
+	Ring     ConsistentHashRing
+	SelfAddr string
+	Pending  bool
+}
+
+// Asks a BlockStore to copy the listed blocks it holds to DestAddr
+type BlockTransfer struct {
+	BlockHashes []string
+	DestAddr    string
+	Options     TransferOptions
+}
+
+// Blocks and bytes a BlockStore actually sent in a CopyBlocks call
+type TransferStats struct {
+	Blocks int
+	Bytes  int
+}
+
+// The ring indices [LowerIndex, UpperIndex] of a ring of RingSize indices,
+// wrapping around the end of the ring when LowerIndex > UpperIndex
+type MerkleRange struct {
+	LowerIndex int
+	UpperIndex int
+	RingSize   int
+}
+
+// Asks a BlockStore for the hashes of its blocks in the given leaves of the Merkle tree of Range
+type MerkleLeafRequest struct {
+	Range  MerkleRange
+	Leaves []int
+}
+
+// Asks the BlockStore known to the MetaStore as SelfAddr to drop the blocks it
+// does not host in Ring, which may have a different RingSize than the current one
+type RehashInstruction struct {
+	Ring     ConsistentHashRing
+	SelfAddr string
+	// Blocks to keep although Ring does not place them here, i.e. blocks spilled here
+	Keep []string
+}
+
+// A BlockStore joining the ring. Weight scales the share of the ring it hosts,
+// e.g. proportionally to its capacity; 0 means the default weight of 1.
+type NodeInfo struct {
+	Addr   string
+	Weight int
+}
+
+// A BlockStore map and the epoch of the ring it was computed from
+type BlockStoreRoutes struct {
+	Epoch         int
+	BlockStoreMap map[string][]string
+}
+
+// The ring indices [LowerIndex, UpperIndex], wrapping around the end of the ring when LowerIndex > UpperIndex
+type IndexRange struct {
+	LowerIndex int
+	UpperIndex int
+}
+
+// A virtual node of the ring and the ranges of ring indices it hosts
+type RingNodeInfo struct {
+	Node Node
+	// Index the node hashes to. A node moved off it by a collision sits at a later Node.Index.
+	HashedIndex int
+	Ranges      []IndexRange
+	// Number of ring indices in Ranges
+	Owned int
+}
+
+// The BlockStore ring of a MetaStore, with the virtual nodes in ring order
+type RingInfo struct {
+	RingSize  int
+	Epoch     int
+	Replicas  int
+	Placement string
+	Nodes     []RingNodeInfo
+}
+
+// BlockStores to add to and remove from the ring
+type MembershipChange struct {
+	Add    []NodeInfo
+	Remove []string
+}
+
+// Blocks a migration would copy from SrcAddr to DestAddr
+type PlannedTransfer struct {
+	SrcAddr  string
+	DestAddr string
+	Blocks   int
+	Bytes    int
+}
+
+// What a membership change would do: the resulting ring, the instructions the
+// MetaStore would send and the copies they would make
+type RebalancePlan struct {
+	Ring      ConsistentHashRing
+	Migration MigrationPlan
+	Transfers []PlannedTransfer
 }
 
 type FileMetaData struct {
@@ -27,11 +145,41 @@ type MetaStoreInterface interface {
 	// Retrieve the mapping of BlockStore addresses to block hashes
 	GetBlockStoreMap(blockHashesIn []string, blockStoreMap *map[string][]string) error
 
+	// Retrieve the mapping of BlockStore addresses to block hashes along with the ring epoch
+	GetBlockStoreRoutes(blockHashesIn []string, routes *BlockStoreRoutes) error
+
 	// Add a BlockStore node
-	AddNode(nodeAddr string, succ *bool) error
+	AddNode(nodeInfo NodeInfo, succ *bool) error
 
 	// Remove a BlockStore node
 	RemoveNode(nodeAddr string, succ *bool) error
+
+	// Make a BlockStore node read-only, move its blocks and then remove it
+	DrainNode(nodeAddr string, succ *bool) error
+
+	// Change the weight of a BlockStore node
+	ReweightNode(nodeInfo NodeInfo, succ *bool) error
+
+	// Change the ring size of the cluster
+	ResizeRing(ringSize int, succ *bool) error
+
+	// Get the health state of every BlockStore
+	GetNodeHealth(succ bool, nodeHealth *map[string]string) error
+
+	// Get the progress of a migration job
+	GetMigrationStatus(id int, status *MigrationStatus) error
+
+	// Cancel a migration job and undo its ring change
+	CancelMigration(id int, succ *bool) error
+
+	// Compute what a membership change would do, without doing it
+	PlanMembership(change MembershipChange, plan *RebalancePlan) error
+
+	// Add and remove several BlockStore nodes in one ring change
+	ChangeMembership(change MembershipChange, succ *bool) error
+
+	// Get the BlockStore ring and the ranges each node hosts
+	GetRing(succ bool, ringInfo *RingInfo) error
 }
 
 type BlockStoreInterface interface {
@@ -44,6 +192,48 @@ type BlockStoreInterface interface {
 
 	// Provide a block hash and the result will be stored in hasBlock boolean value
 	HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error
+
+	// Copy the listed blocks to another BlockStore
+	TransferBlocks(transfer BlockTransfer, succ *bool) error
+
+	// Copy the listed blocks to another BlockStore and count what was sent
+	CopyBlocks(transfer BlockTransfer, stats *TransferStats) error
+
+	// Count the listed blocks held and their bytes
+	MeasureBlocks(blockHashes []string, stats *TransferStats) error
+
+	// Reject or accept client writes again
+	SetReadOnly(readOnly bool, succ *bool) error
+
+	// Drop the listed blocks
+	DropBlocks(blockHashes []string, succ *bool) error
+
+	// Answer a health probe
+	Ping(succ bool, alive *bool) error
+
+	// Store a batch of blocks copied from another BlockStore, without an ownership check
+	ReplicateBlocks(blocks []Block, succ *bool) error
+
+	// Get a block held by this BlockStore, without asking other BlockStores on a miss
+	GetLocalBlock(blockHash string, block *Block) error
+
+	// Store a block copied from another BlockStore, without an ownership check
+	ReplicateBlock(block Block, succ *bool) error
+
+	// Adopt a newer ring
+	SetRing(update RingUpdate, succ *bool) error
+
+	// Get the latest known ring
+	GetRing(succ bool, ring *ConsistentHashRing) error
+
+	// List the blocks in a range of ring indices
+	ListBlocks(inst MigrationInstruction, blockHashes *[]string) error
+
+	// Get the Merkle trees of the blocks in the given ranges
+	GetMerkleTrees(ranges []MerkleRange, trees *[]MerkleTree) error
+
+	// Get the hashes of the blocks in some leaves of a Merkle tree
+	GetMerkleLeafHashes(request MerkleLeafRequest, blockHashes *[]string) error
 }
 
 type ClientInterface interface {
@@ -59,6 +249,15 @@ type ClientInterface interface {
 }
 
 type AdminInterface interface {
-	AddNode(nodeAddr string, succ *bool) error
+	AddNode(nodeInfo NodeInfo, succ *bool) error
 	RemoveNode(nodeAddr string, succ *bool) error
+	DrainNode(nodeAddr string, succ *bool) error
+	ReweightNode(nodeInfo NodeInfo, succ *bool) error
+	ResizeRing(ringSize int, succ *bool) error
+	GetNodeHealth(succ bool, nodeHealth *map[string]string) error
+	GetMigrationStatus(id int, status *MigrationStatus) error
+	CancelMigration(id int, succ *bool) error
+	PlanMembership(change MembershipChange, plan *RebalancePlan) error
+	ChangeMembership(change MembershipChange, succ *bool) error
+	GetRing(succ bool, ringInfo *RingInfo) error
 }
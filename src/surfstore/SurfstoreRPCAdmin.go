@@ -9,16 +9,16 @@ type RPCAdmin struct {
 	MetaStoreAddr string
 }
 
-func (surfAdmin *RPCAdmin) AddNode(nodeAddr string, succ *bool) error {
+func (surfAdmin *RPCAdmin) AddNode(nodeInfo NodeInfo, succ *bool) error {
 	// connect to the server
-	fmt.Println("[surfAdmin.AddNode]", surfAdmin.MetaStoreAddr, nodeAddr)
+	fmt.Println("[surfAdmin.AddNode]", surfAdmin.MetaStoreAddr, nodeInfo.Addr, nodeInfo.Weight)
 	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
 	if e != nil {
 		return e
 	}
 
 	// perform the call
-	e = conn.Call("MetaStore.AddNode", nodeAddr, succ)
+	e = conn.Call("MetaStore.AddNode", nodeInfo, succ)
 	if e != nil {
 		conn.Close()
 		return e
@@ -46,6 +46,168 @@ func (surfAdmin *RPCAdmin) RemoveNode(nodeAddr string, succ *bool) error {
 	return conn.Close()
 }
 
+func (surfAdmin *RPCAdmin) DrainNode(nodeAddr string, succ *bool) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.DrainNode", nodeAddr, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfAdmin *RPCAdmin) ReweightNode(nodeInfo NodeInfo, succ *bool) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.ReweightNode", nodeInfo, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfAdmin *RPCAdmin) ResizeRing(ringSize int, succ *bool) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.ResizeRing", ringSize, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfAdmin *RPCAdmin) GetNodeHealth(succ bool, nodeHealth *map[string]string) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.GetNodeHealth", succ, nodeHealth)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfAdmin *RPCAdmin) GetMigrationStatus(id int, status *MigrationStatus) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.GetMigrationStatus", id, status)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfAdmin *RPCAdmin) CancelMigration(id int, succ *bool) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.CancelMigration", id, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfAdmin *RPCAdmin) PlanMembership(change MembershipChange, plan *RebalancePlan) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.PlanMembership", change, plan)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfAdmin *RPCAdmin) ChangeMembership(change MembershipChange, succ *bool) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.ChangeMembership", change, succ)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfAdmin *RPCAdmin) GetRing(succ bool, ringInfo *RingInfo) error {
+	// connect to the server
+	conn, e := rpc.DialHTTP("tcp", surfAdmin.MetaStoreAddr)
+	if e != nil {
+		return e
+	}
+
+	// perform the call
+	e = conn.Call("MetaStore.GetRing", succ, ringInfo)
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	// close the connection
+	return conn.Close()
+}
+
 var _ AdminInterface = new(RPCAdmin)
 
 // Create an Surfstore RPC client
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"surfstore"
+	"text/tabwriter"
 )
 
 // Usage String
-const USAGE_STRING = "./run-admin.sh -s <service_type> <MetaStoreAddr> <BlockStoreAddr>"
+const USAGE_STRING = "./run-admin.sh -s <service_type> -w <weight> -r <ring_size> -i <migration_id> -a <add_addrs> -d <remove_addrs> [-j] <MetaStoreAddr> (BlockStoreAddr)"
 
-// Set of valid services
-var SERVICE_TYPES = map[string]bool{"add": true, "remove": true}
+// Set of valid services, with the number of addresses each one takes
+var SERVICE_TYPES = map[string]int{"add": 2, "remove": 2, "drain": 2, "reweight": 2, "resize": 1, "health": 1, "status": 1, "cancel": 1, "plan": 1, "change": 1, "ring": 1}
 
 // Exit codes
 const EX_USAGE int = 64
@@ -28,28 +31,187 @@ func main() {
 		})
 	}
 
-	service := flag.String("s", "", "(required) Admin Service: add or remove")
+	service := flag.String("s", "", "(required) Admin Service: add, remove, drain, reweight, resize, health, status, cancel, plan, change or ring")
+	weight := flag.Int("w", 1, "(default = 1) Weight of the BlockStore for add and reweight, e.g. proportional to its capacity")
+	ringSize := flag.Int("r", 0, "(required for resize) New consistent hashing ring size")
+	migrationId := flag.Int("i", 0, "(default = 0, the latest) Migration job for status and cancel")
+	addAddrs := flag.String("a", "", "Comma-separated BlockStores that plan and change add, with weight -w")
+	removeAddrs := flag.String("d", "", "Comma-separated BlockStores that plan and change remove")
+	printJSON := flag.Bool("j", false, "Print the ring as JSON instead of a table")
 	flag.Parse()
 
 	// Valid service type argument
-	if _, ok := SERVICE_TYPES[strings.ToLower(*service)]; !ok {
+	argCount, ok := SERVICE_TYPES[strings.ToLower(*service)]
+	if !ok || len(flag.Args()) != argCount {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
 
 	args := flag.Args()
 	metaHostPort := args[0]
-	blockHostPort := args[1]
+	blockHostPort := ""
+	if argCount > 1 {
+		blockHostPort = args[1]
+	}
 
 	rpcAdmin := surfstore.NewSurfstoreRPCAdmin(metaHostPort)
 	succ := false
 	var err error
+	nodeInfo := surfstore.NodeInfo{Addr: blockHostPort, Weight: *weight}
 	if *service == "add" {
-		err = rpcAdmin.AddNode(blockHostPort, &succ)
+		err = rpcAdmin.AddNode(nodeInfo, &succ)
 	} else if *service == "remove" {
 		err = rpcAdmin.RemoveNode(blockHostPort, &succ)
+	} else if *service == "drain" {
+		err = rpcAdmin.DrainNode(blockHostPort, &succ)
+	} else if *service == "reweight" {
+		err = rpcAdmin.ReweightNode(nodeInfo, &succ)
+	} else if *service == "change" {
+		err = rpcAdmin.ChangeMembership(membershipChange(*addAddrs, *removeAddrs, *weight), &succ)
+	} else if *service == "plan" {
+		change := membershipChange(*addAddrs, *removeAddrs, *weight)
+		plan := surfstore.RebalancePlan{}
+		if err = rpcAdmin.PlanMembership(change, &plan); err == nil {
+			printPlan(plan)
+		}
+	} else if *service == "ring" {
+		ringInfo := surfstore.RingInfo{}
+		if err = rpcAdmin.GetRing(true, &ringInfo); err == nil {
+			err = printRing(ringInfo, *printJSON)
+		}
+	} else if *service == "status" {
+		err = printMigrationStatus(rpcAdmin, *migrationId)
+	} else if *service == "cancel" {
+		if err = rpcAdmin.CancelMigration(*migrationId, &succ); err == nil {
+			err = printMigrationStatus(rpcAdmin, *migrationId)
+		}
+	} else if *service == "resize" {
+		err = rpcAdmin.ResizeRing(*ringSize, &succ)
+	} else if *service == "health" {
+		nodeHealth := make(map[string]string)
+		err = rpcAdmin.GetNodeHealth(true, &nodeHealth)
+		addrs := make([]string, 0, len(nodeHealth))
+		for addr := range nodeHealth {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			fmt.Println(addr, nodeHealth[addr])
+		}
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the blocks of a membership change or resize move in the background
+	if *service == "add" || *service == "remove" || *service == "drain" || *service == "reweight" || *service == "change" || *service == "resize" {
+		if err = printMigrationStatus(rpcAdmin, 0); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Print the progress of a migration job, the latest one if id is 0
+func printMigrationStatus(rpcAdmin surfstore.RPCAdmin, id int) error {
+	status := surfstore.MigrationStatus{}
+	if err := rpcAdmin.GetMigrationStatus(id, &status); err != nil {
+		return err
+	}
+	fmt.Printf("migration %d: %s (ring epoch %d) %s\n", status.Id, status.Change, status.Epoch, status.State)
+	printCollisions(status.Collisions)
+	fmt.Printf("moved %d blocks (%d bytes), %d blocks remaining\n", status.BlocksMoved, status.BytesMoved, status.BlocksRemaining)
+	if status.Error != "" {
+		fmt.Println("error:", status.Error)
+	}
+	return nil
+}
+
+// Print the virtual nodes a ring change moved off their hashed index
+func printCollisions(collisions []surfstore.Collision) {
+	for _, collision := range collisions {
+		fmt.Printf("collision: %s token %d moved from index %d to %d\n",
+			collision.Node.Addr, collision.Node.Token, collision.HashedIndex, collision.Node.Index)
+	}
+}
+
+// The membership change adding the BlockStores in addAddrs with weight and removing those in removeAddrs
+func membershipChange(addAddrs string, removeAddrs string, weight int) surfstore.MembershipChange {
+	change := surfstore.MembershipChange{Remove: splitAddrs(removeAddrs)}
+	for _, addr := range splitAddrs(addAddrs) {
+		change.Add = append(change.Add, surfstore.NodeInfo{Addr: addr, Weight: weight})
+	}
+	return change
+}
+
+// Print the ring as a table of its virtual nodes in ring order, or as JSON
+func printRing(ringInfo surfstore.RingInfo, asJSON bool) error {
+	if asJSON {
+		out, err := json.MarshalIndent(ringInfo, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	placement := ringInfo.Placement
+	if placement == "" {
+		placement = "ring"
+	}
+	fmt.Printf("ring size %d, epoch %d, replicas %d, placement %s\n", ringInfo.RingSize, ringInfo.Epoch, ringInfo.Replicas, placement)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tHASHED\tADDR\tTOKEN\tWEIGHT\tOWNED\tRANGES")
+	for _, nodeInfo := range ringInfo.Nodes {
+		ranges := make([]string, 0, len(nodeInfo.Ranges))
+		for _, r := range nodeInfo.Ranges {
+			ranges = append(ranges, fmt.Sprintf("[%d, %d]", r.LowerIndex, r.UpperIndex))
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%d\t%d\t%s\n", nodeInfo.Node.Index, nodeInfo.HashedIndex, nodeInfo.Node.Addr, nodeInfo.Node.Token,
+			nodeInfo.Node.Weight, nodeInfo.Owned, strings.Join(ranges, " "))
+	}
+	return w.Flush()
+}
+
+// Split a comma-separated list of addresses
+func splitAddrs(list string) []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Print the resulting ring, the instructions and the copies of a plan
+func printPlan(plan surfstore.RebalancePlan) {
+	fmt.Printf("ring epoch %d, size %d\n", plan.Ring.Epoch, plan.Ring.RingSize)
+	for _, addr := range plan.Ring.Addrs() {
+		fmt.Printf("  %s weight %d\n", addr, plan.Ring.NodeWeight(addr))
+	}
+	printCollisions(plan.Ring.Collisions())
+
+	fmt.Println("instructions:")
+	for _, step := range plan.Migration.Copies {
+		fmt.Printf("  copy [%d, %d] from %s to %s\n", step.Inst.LowerIndex, step.Inst.UpperIndex, step.SrcAddr, step.Inst.DestAddr)
+	}
+	for _, step := range plan.Migration.BlockCopies {
+		fmt.Printf("  copy %d spilled blocks from %s to %s\n", len(step.Transfer.BlockHashes), step.SrcAddr, step.Transfer.DestAddr)
+	}
+	for _, step := range plan.Migration.Deletes {
+		fmt.Printf("  delete [%d, %d] from %s\n", step.Inst.LowerIndex, step.Inst.UpperIndex, step.SrcAddr)
+	}
+	for _, step := range plan.Migration.BlockDeletes {
+		fmt.Printf("  delete %d spilled blocks from %s\n", len(step.Transfer.BlockHashes), step.SrcAddr)
+	}
+
+	fmt.Println("copies:")
+	blocks, bytes := 0, 0
+	for _, transfer := range plan.Transfers {
+		fmt.Printf("  %s -> %s: %d blocks, %d bytes\n", transfer.SrcAddr, transfer.DestAddr, transfer.Blocks, transfer.Bytes)
+		blocks += transfer.Blocks
+		bytes += transfer.Bytes
+	}
+	fmt.Printf("total: %d blocks, %d bytes\n", blocks, bytes)
+	if plan.Migration.Unreachable > 0 {
+		fmt.Printf("%d ring indices or spilled blocks have no live copy and would be lost\n", plan.Migration.Unreachable)
+	}
 }
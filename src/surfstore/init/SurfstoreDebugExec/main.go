@@ -24,7 +24,7 @@ func main() {
 		})
 	}
 
-	ringSize := flag.Int("r", 128, "(default = 128) Consistent hashing ring size")
+	ringSize := flag.Int("r", 0, "(default = ring size of the BlockStore) Consistent hashing ring size")
 	flag.Parse()
 	args := flag.Args()
 
@@ -51,6 +51,15 @@ func main() {
 		return
 	}
 
+	// use the ring size the BlockStore is running with unless overridden
+	if *ringSize == 0 {
+		e = conn.Call("BlockStore.GetRingSize", succ, ringSize)
+		if e != nil {
+			conn.Close()
+			return
+		}
+	}
+
 	PrintBlockMap(blockMap, *ringSize)
 
 	// close the connection
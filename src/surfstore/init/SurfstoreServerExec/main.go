@@ -12,17 +12,37 @@ import (
 	"strconv"
 	"strings"
 	"surfstore"
+	"time"
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -r <ring_size> -l -d (BlockStoreAddr*)"
+const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -r <ring_size> -n <replicas> -t <tokens> -a <placement> -e <load_factor> -b <block_dir> -m <meta_dir> -c <meta_replicas> -i <replica_id> -f <meta_shards> -k <probe_interval> -o <dead_policy> -g <gossip_interval> -x <repair_interval> -u <batch_bytes> -j <parallelism> -y <bytes_per_second> -l -d (BlockStoreAddr*)"
 
 // Set of valid services
-var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
+var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true, "router": true}
 
 // Exit codes
 const EX_USAGE int = 64
 
+// Server settings taken from the command line
+type serverConfig struct {
+	ringSize     int
+	replicas     int
+	tokens       int
+	placement    string
+	epsilon      float64
+	blockDir     string
+	metaDir      string
+	metaReplicas []string
+	replicaId    int
+	metaShards   []string
+	probeEvery   time.Duration
+	deadPolicy   string
+	gossipEvery  time.Duration
+	repairEvery  time.Duration
+	transfers    surfstore.TransferOptions
+}
+
 func main() {
 	// Custom flag Usage message
 	flag.Usage = func() {
@@ -35,12 +55,35 @@ func main() {
 	}
 
 	// Parse command-line argument flags
-	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both")
+	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both, router")
 	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
 	localOnly := flag.Bool("l", false, "Only listen on localhost")
 	debug := flag.Bool("d", false, "Output log statements")
-	ringSize := flag.Int("r", 128, "(default = 128) Consistent hashing ring size")
+	config := serverConfig{}
+	flag.IntVar(&config.ringSize, "r", 128, "(default = 128) Consistent hashing ring size")
+	flag.IntVar(&config.replicas, "n", 1, "(default = 1) Number of BlockStores holding a copy of each block")
+	flag.IntVar(&config.tokens, "t", 1, "(default = 1) Number of virtual nodes per BlockStore on the consistent hashing ring")
+	flag.StringVar(&config.placement, "a", "ring", "(default = ring) Block placement algorithm: ring, rendezvous, jump or maglev")
+	flag.Float64Var(&config.epsilon, "e", 0, "(default = 0, off) Bounded-load epsilon: a BlockStore holds at most (1+e) times its share of the blocks")
+	flag.StringVar(&config.blockDir, "b", "", "(default = in-memory) Directory for persistent BlockStore storage")
+	flag.StringVar(&config.metaDir, "m", "", "(default = in-memory) Directory for the MetaStore write-ahead log and snapshots")
+	metaReplicaList := flag.String("c", "", "(default = not replicated) Comma-separated addresses of all MetaStore replicas, including this server")
+	flag.IntVar(&config.replicaId, "i", 0, "(default = 0) Position of this server in the -c list")
+	metaShardList := flag.String("f", "", "(required for router) Comma-separated addresses of the MetaStore shards, the first one owns the BlockStore ring")
+	flag.DurationVar(&config.probeEvery, "k", 0, "(default = 0, off) Interval of the MetaStore health probes of the BlockStores, e.g. 1s")
+	flag.StringVar(&config.deadPolicy, "o", surfstore.DeadNodeIgnore, "(default = none) What the MetaStore does about dead BlockStores: none, route or remove")
+	flag.DurationVar(&config.gossipEvery, "g", 0, "(default = 0, off) Gossip interval of the BlockStores and ring publishing interval of the MetaStore, e.g. 500ms")
+	flag.DurationVar(&config.repairEvery, "x", 0, "(default = 0, off) Interval of the MetaStore anti-entropy rounds that repair misplaced and missing blocks, e.g. 1m")
+	flag.IntVar(&config.transfers.BatchBytes, "u", surfstore.DefaultTransferBatchBytes, "(default = 4 MiB) Approximate number of bytes per batch of blocks copied between BlockStores")
+	flag.IntVar(&config.transfers.Parallelism, "j", 1, "(default = 1) Number of batches of blocks in flight per copy between BlockStores")
+	flag.IntVar(&config.transfers.BytesPerSecond, "y", 0, "(default = 0, unlimited) Bandwidth limit in bytes per second of each copy between BlockStores")
 	flag.Parse()
+	if *metaReplicaList != "" {
+		config.metaReplicas = strings.Split(*metaReplicaList, ",")
+	}
+	if *metaShardList != "" {
+		config.metaShards = strings.Split(*metaShardList, ",")
+	}
 
 	// Use tail arguments to hold variable number of BlockStore addresses
 	blockStoreAddrs := flag.Args()
@@ -64,21 +107,91 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), *ringSize, blockStoreAddrs))
+	log.Fatal(startServer(addr, strings.ToLower(*service), config, blockStoreAddrs))
 }
 
-func startServer(hostAddr string, serviceType string, ringSize int, blockStoreAddrs []string) error {
+func startServer(hostAddr string, serviceType string, config serverConfig, blockStoreAddrs []string) error {
 	// Create a new Server
 	rpcServer := rpc.NewServer()
 
 	// Register rpc services
-	if serviceType != "block" {
-		metastore := surfstore.NewMetaStore(surfstore.NewConsistentHashRing(ringSize, blockStoreAddrs))
+	if serviceType == "router" {
+		router, e := surfstore.NewMetaRouter(config.metaShards)
+		if e != nil {
+			return e
+		}
+		rpcServer.RegisterName("MetaStore", &router)
+	}
+
+	if serviceType == "meta" || serviceType == "both" {
+		ring, e := surfstore.NewVirtualConsistentHashRing(config.ringSize, config.tokens, blockStoreAddrs)
+		if e != nil {
+			return e
+		}
+		ring.Replicas = config.replicas
+		if config.epsilon < 0 {
+			return fmt.Errorf("invalid load factor %g", config.epsilon)
+		}
+		ring.LoadFactor = config.epsilon
+		if e := ring.SetPlacement(config.placement); e != nil {
+			return e
+		}
+		metastore := surfstore.NewMetaStore(ring)
+		if len(config.metaReplicas) > 0 {
+			// the Raft log takes the place of the MetaStore log
+			if e := metastore.StartReplication(config.metaReplicas, config.replicaId, config.metaDir); e != nil {
+				return e
+			}
+			rpcServer.RegisterName("Raft", metastore.Raft)
+		} else if config.metaDir != "" {
+			metastore, e = surfstore.NewPersistentMetaStore(ring, config.metaDir, surfstore.DefaultSnapshotEvery)
+			if e != nil {
+				return e
+			}
+		}
+		metastore.TransferOptions = config.transfers
+		if config.probeEvery > 0 {
+			if e := metastore.StartHealthChecks(surfstore.DefaultHealthConfig(config.probeEvery, config.deadPolicy)); e != nil {
+				return e
+			}
+		}
+		if config.gossipEvery > 0 {
+			if e := metastore.StartRingPublisher(config.gossipEvery); e != nil {
+				return e
+			}
+		}
+		if config.repairEvery > 0 {
+			if e := metastore.StartAntiEntropy(config.repairEvery); e != nil {
+				return e
+			}
+		}
+		if len(config.metaReplicas) == 0 {
+			// finish a membership change interrupted by a crash, once the server is up.
+			// A replicated MetaStore does so whenever it becomes the Raft leader.
+			go func() {
+				if e := metastore.ResumeMigration(); e != nil {
+					log.Println("Could not resume the migration:", e)
+				}
+			}()
+		}
 		rpcServer.RegisterName("MetaStore", &metastore)
 	}
 
-	if serviceType != "meta" {
-		blockstore := surfstore.NewBlockStore(ringSize)
+	if serviceType == "block" || serviceType == "both" {
+		blockstore := surfstore.NewBlockStore(config.ringSize)
+		if config.blockDir != "" {
+			var e error
+			blockstore, e = surfstore.NewDiskBlockStore(config.ringSize, config.blockDir)
+			if e != nil {
+				return e
+			}
+			log.Println("Serving blocks from", config.blockDir)
+		}
+		if config.gossipEvery > 0 {
+			if e := blockstore.StartGossip(surfstore.DefaultGossipConfig(config.gossipEvery)); e != nil {
+				return e
+			}
+		}
 		rpcServer.RegisterName("BlockStore", &blockstore)
 	}
 